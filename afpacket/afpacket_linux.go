@@ -0,0 +1,490 @@
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Linux constants not defined by the syscall package
+const (
+	ethPAll = 0x0003
+
+	packetAddMembership = 1
+	packetMRPromisc     = 1
+
+	packetRXRing     = 5
+	packetStatistics = 6
+	packetVersion    = 10
+	packetFanout     = 18
+
+	tpacketV3 = 2
+
+	tpStatusKernel    = 0
+	tpStatusUser      = 1 << 0
+	tpStatusVLANValid = 1 << 4
+	tpStatusVLANTPID  = 1 << 6
+
+	pollIn = 0x0001
+)
+
+// Offsets in the TPACKET_V3 block descriptor and packet header
+const (
+	blockStatusOffset      = 8
+	blockNumPktsOffset     = 12
+	blockFirstPacketOffset = 16
+
+	pktNextOffset     = 0
+	pktSecOffset      = 4
+	pktNsecOffset     = 8
+	pktSnapLenOffset  = 12
+	pktLenOffset      = 16
+	pktStatusOffset   = 20
+	pktMACOffset      = 24
+	pktVLANTCIOffset  = 32
+	pktVLANTPIDOffset = 36
+)
+
+// hostOrder is the byte order of the ring headers, which is the host's
+var hostOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	v := uint16(1)
+	if *(*byte)(unsafe.Pointer(&v)) == 0 {
+		hostOrder = binary.BigEndian
+	}
+}
+
+// FanoutType is the PACKET_FANOUT mode used to spread packets over the
+// sockets of a fanout group.
+type FanoutType int
+
+// Fanout modes
+const (
+	FanoutHash        FanoutType = 0
+	FanoutLoadBalance FanoutType = 1
+	FanoutCPU         FanoutType = 2
+	// FanoutHashWithDefrag hashes flows after reassembling IP fragments
+	FanoutHashWithDefrag FanoutType = 0x8000
+)
+
+// Default ring settings
+const (
+	DefaultBlockSize    = 1 << 20
+	DefaultNumBlocks    = 64
+	DefaultFrameSize    = 1 << 11
+	DefaultBlockTimeout = 64 * time.Millisecond
+	DefaultPollTimeout  = 100 * time.Millisecond
+)
+
+// ErrTimeout is returned by ReadPacketData when no packet arrived within
+// the poll timeout.
+var ErrTimeout = errors.New("afpacket: poll timeout")
+
+// Options configures a TPacket. Zero values select the defaults, as do
+// negative timeouts.
+type Options struct {
+	// Interface is the name of the interface to bind to
+	Interface string
+	// SnapLen is the maximum number of bytes returned of each packet,
+	// zero for the whole packet
+	SnapLen int
+	// Promiscuous puts the interface in promiscuous mode
+	Promiscuous bool
+	// BlockSize is the size of each ring block, a multiple of the page size
+	BlockSize int
+	// NumBlocks is the number of blocks in the ring
+	NumBlocks int
+	// FrameSize is the nominal frame size, used to size the ring
+	FrameSize int
+	// BlockTimeout is how long the kernel waits before retiring a block
+	// that is not full, with millisecond granularity
+	BlockTimeout time.Duration
+	// PollTimeout is how long ReadPacketData waits for a block before
+	// returning ErrTimeout
+	PollTimeout time.Duration
+}
+
+// Stats holds the cumulative kernel counters of a socket.
+type Stats struct {
+	// Packets is the number of packets seen by the socket, including drops
+	Packets uint64
+	// Drops is the number of packets dropped because the ring was full
+	Drops uint64
+	// FreezeQueueCount is the number of times the ring was frozen
+	FreezeQueueCount uint64
+}
+
+// tpacketReq3 is struct tpacket_req3
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// tpacketStatsV3 is struct tpacket_stats_v3
+type tpacketStatsV3 struct {
+	packets      uint32
+	drops        uint32
+	freezeQCount uint32
+}
+
+// packetMreq is struct packet_mreq
+type packetMreq struct {
+	ifIndex int32
+	mrType  uint16
+	alen    uint16
+	address [8]byte
+}
+
+// pollFd is struct pollfd
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// TPacket is an AF_PACKET socket reading from a TPACKET_V3 ring.
+type TPacket struct {
+	fd          int
+	ring        []byte
+	snapLen     int
+	blockSize   int
+	numBlocks   int
+	pollTimeout time.Duration
+
+	mu sync.Mutex // guards below
+	// block is the index of the current block and held reports whether it
+	// is owned by user space
+	block int
+	held  bool
+	// remaining is the number of unread packets in the current block and
+	// offset the offset of the next one
+	remaining uint32
+	offset    uint32
+	stats     Stats
+	closed    bool
+}
+
+// NewTPacket opens an AF_PACKET socket bound to an interface and maps its
+// TPACKET_V3 receive ring.
+func NewTPacket(opts Options) (*TPacket, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	if opts.NumBlocks == 0 {
+		opts.NumBlocks = DefaultNumBlocks
+	}
+	if opts.FrameSize == 0 {
+		opts.FrameSize = DefaultFrameSize
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = DefaultBlockTimeout
+	}
+	if opts.PollTimeout <= 0 {
+		opts.PollTimeout = DefaultPollTimeout
+	}
+	if opts.BlockSize%syscall.Getpagesize() != 0 || opts.BlockSize%opts.FrameSize != 0 {
+		return nil, errors.New("afpacket: block size must be a multiple of the page and frame sizes")
+	}
+
+	iface, err := net.InterfaceByName(opts.Interface)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPAll)))
+	if err != nil {
+		return nil, err
+	}
+
+	h := &TPacket{
+		fd:          fd,
+		snapLen:     opts.SnapLen,
+		blockSize:   opts.BlockSize,
+		numBlocks:   opts.NumBlocks,
+		pollTimeout: opts.PollTimeout,
+	}
+
+	if err := h.setup(iface.Index, opts); err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// setup sets the TPACKET version, maps the ring and binds the socket.
+func (h *TPacket) setup(ifIndex int, opts Options) error {
+	if err := syscall.SetsockoptInt(h.fd, syscall.SOL_PACKET, packetVersion, tpacketV3); err != nil {
+		return err
+	}
+
+	req := tpacketReq3{
+		blockSize:    uint32(opts.BlockSize),
+		blockNr:      uint32(opts.NumBlocks),
+		frameSize:    uint32(opts.FrameSize),
+		frameNr:      uint32(opts.BlockSize / opts.FrameSize * opts.NumBlocks),
+		retireBlkTov: uint32(opts.BlockTimeout / time.Millisecond),
+	}
+	if err := setsockopt(h.fd, syscall.SOL_PACKET, packetRXRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return err
+	}
+
+	ring, err := syscall.Mmap(h.fd, 0, opts.BlockSize*opts.NumBlocks,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_LOCKED)
+	if err != nil {
+		// Locking the ring needs CAP_IPC_LOCK, fall back to an unlocked ring
+		ring, err = syscall.Mmap(h.fd, 0, opts.BlockSize*opts.NumBlocks,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			return err
+		}
+	}
+	h.ring = ring
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPAll),
+		Ifindex:  ifIndex,
+	}
+	if err := syscall.Bind(h.fd, addr); err != nil {
+		return err
+	}
+
+	// Promiscuous mode is dropped by the kernel when the socket is closed
+	if opts.Promiscuous {
+		mreq := packetMreq{ifIndex: int32(ifIndex), mrType: packetMRPromisc}
+		return setsockopt(h.fd, syscall.SOL_PACKET, packetAddMembership, unsafe.Pointer(&mreq), unsafe.Sizeof(mreq))
+	}
+
+	return nil
+}
+
+// SetFanout joins the socket to a PACKET_FANOUT group. Every socket of the
+// group must be bound to the same interface and use the same mode.
+func (h *TPacket) SetFanout(t FanoutType, id uint16) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return syscall.SetsockoptInt(h.fd, syscall.SOL_PACKET, packetFanout, int(t)<<16|int(id))
+}
+
+// SetBPF attaches a compiled BPF program to the socket so the kernel only
+// places matching packets in the ring.
+func (h *TPacket) SetBPF(filter []syscall.SockFilter) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(filter) == 0 {
+		return errors.New("afpacket: empty BPF program")
+	}
+
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	return setsockopt(h.fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, unsafe.Pointer(&prog), unsafe.Sizeof(prog))
+}
+
+// LinkType returns the link type of the captured packets.
+func (h *TPacket) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// ReadPacketData returns a copy of the next packet in the ring. It returns
+// ErrTimeout if no packet arrives within the poll timeout, and io.EOF once
+// the socket is closed.
+func (h *TPacket) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for {
+		if h.closed {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+
+		if h.remaining > 0 {
+			return h.readPacket()
+		}
+
+		// Hand the block back to the kernel and move on to the next one
+		if h.held {
+			atomic.StoreUint32(h.blockWord(blockStatusOffset), tpStatusKernel)
+			h.held = false
+			h.block = (h.block + 1) % h.numBlocks
+		}
+
+		if atomic.LoadUint32(h.blockWord(blockStatusOffset))&tpStatusUser == 0 {
+			h.mu.Unlock()
+			err := h.poll()
+			h.mu.Lock()
+			if err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+			continue
+		}
+
+		h.held = true
+		h.remaining = *h.blockWord(blockNumPktsOffset)
+		h.offset = *h.blockWord(blockFirstPacketOffset)
+	}
+}
+
+// blockWord returns a pointer to a 32 bit word of the current block.
+func (h *TPacket) blockWord(offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&h.ring[h.block*h.blockSize+offset]))
+}
+
+// readPacket copies the packet at the current offset of the current block,
+// reinserting the VLAN tag stripped by the kernel.
+func (h *TPacket) readPacket() ([]byte, gopacket.CaptureInfo, error) {
+	block := h.ring[h.block*h.blockSize : (h.block+1)*h.blockSize]
+	hdr := block[h.offset:]
+
+	sec := hostOrder.Uint32(hdr[pktSecOffset:])
+	nsec := hostOrder.Uint32(hdr[pktNsecOffset:])
+	snapLen := int(hostOrder.Uint32(hdr[pktSnapLenOffset:]))
+	length := int(hostOrder.Uint32(hdr[pktLenOffset:]))
+	status := hostOrder.Uint32(hdr[pktStatusOffset:])
+	mac := int(hostOrder.Uint16(hdr[pktMACOffset:]))
+	if h.snapLen > 0 && snapLen > h.snapLen {
+		snapLen = h.snapLen
+	}
+	frame := hdr[mac : mac+snapLen]
+
+	var data []byte
+	if status&tpStatusVLANValid != 0 && snapLen >= 12 {
+		tpid := uint16(layers.EthernetTypeDot1Q)
+		if status&tpStatusVLANTPID != 0 {
+			tpid = hostOrder.Uint16(hdr[pktVLANTPIDOffset:])
+		}
+		tci := uint16(hostOrder.Uint32(hdr[pktVLANTCIOffset:]))
+
+		data = make([]byte, snapLen+4)
+		copy(data, frame[:12])
+		binary.BigEndian.PutUint16(data[12:], tpid)
+		binary.BigEndian.PutUint16(data[14:], tci)
+		copy(data[16:], frame[12:])
+		length += 4
+		if h.snapLen > 0 && len(data) > h.snapLen {
+			data = data[:h.snapLen]
+		}
+		snapLen = len(data)
+	} else {
+		data = make([]byte, snapLen)
+		copy(data, frame)
+	}
+
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(int64(sec), int64(nsec)),
+		CaptureLength: snapLen,
+		Length:        length,
+	}
+
+	h.remaining--
+	h.offset += hostOrder.Uint32(hdr[pktNextOffset:])
+
+	return data, ci, nil
+}
+
+// poll waits for the kernel to hand over a block.
+func (h *TPacket) poll() error {
+	fds := []pollFd{{fd: int32(h.fd), events: pollIn}}
+	ts := syscall.NsecToTimespec(int64(h.pollTimeout))
+
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1,
+		uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno == syscall.EINTR {
+		return nil
+	}
+	if errno != 0 {
+		return errno
+	}
+	if n == 0 {
+		return ErrTimeout
+	}
+
+	return nil
+}
+
+// Stats returns the cumulative kernel counters of the socket.
+func (h *TPacket) Stats() (Stats, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return h.stats, nil
+	}
+
+	// Reading the counters resets them in the kernel
+	var s tpacketStatsV3
+	size := uint32(unsafe.Sizeof(s))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(h.fd), syscall.SOL_PACKET, packetStatistics,
+		uintptr(unsafe.Pointer(&s)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return h.stats, errno
+	}
+
+	h.stats.Packets += uint64(s.packets)
+	h.stats.Drops += uint64(s.drops)
+	h.stats.FreezeQueueCount += uint64(s.freezeQCount)
+
+	return h.stats, nil
+}
+
+// Close unmaps the ring and closes the socket. Pending and later calls to
+// ReadPacketData return io.EOF.
+func (h *TPacket) Close() {
+	// Collect the final counters before the socket goes away
+	h.Stats()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+
+	if h.ring != nil {
+		syscall.Munmap(h.ring)
+		h.ring = nil
+	}
+	syscall.Close(h.fd)
+}
+
+// setsockopt sets a socket option from a structure.
+func setsockopt(fd, level, name int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// htons converts a short from host to network byte order, which only swaps
+// its bytes on little-endian hosts.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return hostOrder.Uint16(b[:])
+}
@@ -0,0 +1,9 @@
+/*
+Package afpacket implements live packet capture on Linux using an AF_PACKET
+socket with a memory-mapped TPACKET_V3 receive ring, optionally joined to a
+PACKET_FANOUT group so several sockets share the load of an interface.
+
+Packets are returned through ReadPacketData, so a TPacket can be used as a
+gopacket.PacketDataSource.
+*/
+package afpacket
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Capture backends
+const (
+	backendPCAP     = "pcap"
+	backendAFPacket = "afpacket"
+)
+
+// captureOptions holds the options of a live capture
+type captureOptions struct {
+	SnapLen     int
+	Promiscuous bool
+	Timeout     time.Duration
+	Filter      string
+	Backend     string
+	// AF_PACKET backend options
+	Fanout        string
+	FanoutID      int
+	FanoutSockets int
+	BlockSize     int
+	NumBlocks     int
+}
+
+// captureStats holds the counters of a capture handle
+type captureStats struct {
+	Received  uint64
+	Dropped   uint64
+	IfDropped uint64
+}
+
+// captureHandle is a live capture handle of one of the capture backends
+type captureHandle interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	Stats() (captureStats, error)
+	Close()
+}
+
+// pcapHandle is a capture handle of the libpcap backend
+type pcapHandle struct {
+	*pcap.Handle
+}
+
+// Stats returns the libpcap counters of the handle.
+func (h pcapHandle) Stats() (captureStats, error) {
+	stats, err := h.Handle.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+
+	return captureStats{
+		Received:  uint64(stats.PacketsReceived),
+		Dropped:   uint64(stats.PacketsDropped),
+		IfDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+// openLive starts a live capture on a device with the configured backend
+// and returns its handles. Only the AF_PACKET backend returns more than one
+// handle, one per fanout socket.
+func openLive(device string, devIndex int, opts captureOptions) ([]captureHandle, error) {
+	switch opts.Backend {
+	case backendPCAP, "":
+		handle, err := openPCAP(device, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []captureHandle{handle}, nil
+	case backendAFPacket:
+		return openAFPacket(device, devIndex, opts)
+	}
+
+	return nil, fmt.Errorf("unknown capture backend %q", opts.Backend)
+}
+
+// openPCAP starts a live capture on a device with libpcap and sets its BPF filter.
+func openPCAP(device string, opts captureOptions) (captureHandle, error) {
+	// A handle blocking forever keeps its lock while waiting for packets and
+	// cannot be closed to stop the capture. Use the same libpcap timeout but
+	// return the timeouts, which the packet source ignores. libpcap also
+	// blocks forever with a zero timeout.
+	timeout := opts.Timeout
+	switch {
+	case timeout == 0:
+		timeout = -pcap.BlockForever
+	case timeout < 0:
+		timeout = -timeout
+	}
+
+	handle, err := pcap.OpenLive(device, int32(opts.SnapLen), opts.Promiscuous, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set filter
+	if opts.Filter != "" {
+		err = handle.SetBPFFilter(opts.Filter)
+		if err != nil {
+			log.Println("Failed to set BPF on", device+":", err)
+		}
+	}
+
+	return pcapHandle{handle}, nil
+}
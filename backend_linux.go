@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+
+	"github.com/kbrebanov/nose-bleed/afpacket"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// afpacketHandle is a capture handle of the AF_PACKET backend
+type afpacketHandle struct {
+	*afpacket.TPacket
+}
+
+// Stats returns the kernel counters of the socket.
+func (h afpacketHandle) Stats() (captureStats, error) {
+	stats, err := h.TPacket.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+
+	return captureStats{
+		Received: stats.Packets,
+		Dropped:  stats.Drops,
+	}, nil
+}
+
+// fanoutTypes maps the -fanout modes to AF_PACKET fanout types
+var fanoutTypes = map[string]afpacket.FanoutType{
+	"hash": afpacket.FanoutHash,
+	"cpu":  afpacket.FanoutCPU,
+	"lb":   afpacket.FanoutLoadBalance,
+}
+
+// openAFPacket opens the AF_PACKET sockets of a device. With fanout, the
+// sockets join a group whose id is offset by the device index, since a
+// group cannot span devices.
+func openAFPacket(device string, devIndex int, opts captureOptions) ([]captureHandle, error) {
+	sockets := 1
+	var fanoutType afpacket.FanoutType
+	if opts.Fanout != "" {
+		var ok bool
+		fanoutType, ok = fanoutTypes[opts.Fanout]
+		if !ok {
+			return nil, fmt.Errorf("unknown fanout mode %q", opts.Fanout)
+		}
+		if opts.FanoutSockets > 1 {
+			sockets = opts.FanoutSockets
+		}
+	}
+
+	// Compile the filter with libpcap to attach it to each socket
+	var filter []syscall.SockFilter
+	if opts.Filter != "" {
+		var err error
+		filter, err = compileBPF(device, opts)
+		if err != nil {
+			log.Println("Failed to set BPF on", device+":", err)
+		}
+	}
+
+	var handles []captureHandle
+	closeAll := func() {
+		for _, h := range handles {
+			h.Close()
+		}
+	}
+
+	for i := 0; i < sockets; i++ {
+		tp, err := afpacket.NewTPacket(afpacket.Options{
+			Interface:    device,
+			SnapLen:      opts.SnapLen,
+			Promiscuous:  opts.Promiscuous,
+			BlockSize:    opts.BlockSize,
+			NumBlocks:    opts.NumBlocks,
+			BlockTimeout: opts.Timeout,
+		})
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		handles = append(handles, afpacketHandle{tp})
+
+		if filter != nil {
+			if err := tp.SetBPF(filter); err != nil {
+				log.Println("Failed to set BPF on", device+":", err)
+			}
+		}
+
+		if opts.Fanout != "" {
+			id := uint16(opts.FanoutID + devIndex)
+			if err := tp.SetFanout(fanoutType, id); err != nil {
+				closeAll()
+				return nil, fmt.Errorf("failed to join fanout group %d: %v", id, err)
+			}
+		}
+	}
+
+	return handles, nil
+}
+
+// compileBPF compiles a BPF filter for a device using a short-lived
+// libpcap handle.
+func compileBPF(device string, opts captureOptions) ([]syscall.SockFilter, error) {
+	handle, err := pcap.OpenLive(device, int32(opts.SnapLen), false, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	instructions, err := handle.CompileBPFFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := make([]syscall.SockFilter, 0, len(instructions))
+	for _, ins := range instructions {
+		filter = append(filter, syscall.SockFilter{Code: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K})
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// openAFPacket is only supported on Linux.
+func openAFPacket(device string, devIndex int, opts captureOptions) ([]captureHandle, error) {
+	return nil, errors.New("the afpacket backend is only supported on Linux")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Batch formats
+const (
+	batchNDJSON = "ndjson"
+	batchArray  = "array"
+)
+
+// Batch compressions
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Time waited for a batch to fill up, unless configured
+const defaultBatchTimeout = time.Second
+
+// batch is a batch of records waiting to be published as one message
+type batch struct {
+	key     string
+	records [][]byte
+	// info merges the info of the records: the type and timestamp of the
+	// first one, the interface if they share it and every protocol
+	info       recordInfo
+	interfaces map[string]bool
+	protocols  map[string]bool
+}
+
+// add adds a record to the batch.
+func (b *batch) add(record []byte, info recordInfo) {
+	if len(b.records) == 0 {
+		b.info.Type = info.Type
+		b.info.Timestamp = info.Timestamp
+	}
+	b.records = append(b.records, record)
+
+	if info.Interface != "" {
+		b.interfaces[info.Interface] = true
+	}
+	for _, protocol := range info.Protocols {
+		b.protocols[protocol] = true
+	}
+}
+
+// mergedInfo returns the info of the batch.
+func (b *batch) mergedInfo() recordInfo {
+	info := b.info
+	if len(b.interfaces) == 1 {
+		for iface := range b.interfaces {
+			info.Interface = iface
+		}
+	}
+	for protocol := range b.protocols {
+		info.Protocols = append(info.Protocols, protocol)
+	}
+	sort.Strings(info.Protocols)
+
+	return info
+}
+
+// encode returns the body of the batch message with its content type.
+func (b *batch) encode(format string) ([]byte, string) {
+	var body bytes.Buffer
+
+	if format == batchArray {
+		body.WriteByte('[')
+		for i, record := range b.records {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(record)
+		}
+		body.WriteByte(']')
+		return body.Bytes(), "application/json"
+	}
+
+	for _, record := range b.records {
+		body.Write(record)
+		body.WriteByte('\n')
+	}
+	return body.Bytes(), "application/x-ndjson"
+}
+
+// batcher groups records by routing key and type into batches, published
+// once they hold size records or timeout after their first record.
+type batcher struct {
+	size        int
+	timeout     time.Duration
+	format      string
+	compression string
+	// flush publishes a batch
+	flush func(b *batch)
+
+	mu      sync.Mutex // guards below
+	batches map[string]*batch
+}
+
+// newBatcher creates a batcher from the batch settings.
+func newBatcher(settings RabbitMQBatchSettings, flush func(b *batch)) (*batcher, error) {
+	b := &batcher{
+		size:        settings.Size,
+		timeout:     defaultBatchTimeout,
+		format:      batchNDJSON,
+		compression: settings.Compression,
+		flush:       flush,
+		batches:     make(map[string]*batch),
+	}
+
+	if settings.TimeoutMS > 0 {
+		b.timeout = time.Duration(settings.TimeoutMS) * time.Millisecond
+	}
+
+	if err := checkBatchFormat(settings.Format); err != nil {
+		return nil, err
+	}
+	if settings.Format != "" {
+		b.format = settings.Format
+	}
+	if err := checkCompression(settings.Compression); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// checkBatchFormat returns an error for an unknown batch format.
+func checkBatchFormat(format string) error {
+	switch format {
+	case "", batchNDJSON, batchArray:
+		return nil
+	}
+	return fmt.Errorf("unknown batch format %q, use %s or %s", format, batchNDJSON, batchArray)
+}
+
+// checkCompression returns an error for an unknown or unsupported batch
+// compression.
+func checkCompression(compression string) error {
+	switch compression {
+	case compressionNone, compressionGzip:
+		return nil
+	case compressionZstd:
+		// No zstd encoder is vendored
+		return fmt.Errorf("zstd batch compression is not supported, as this build vendors no zstd encoder; use gzip")
+	}
+	return fmt.Errorf("unknown batch compression %q, use gzip", compression)
+}
+
+// add adds a record to the batch of its routing key and type, publishing
+// the batch if it is full.
+func (bt *batcher) add(key string, record []byte, info recordInfo) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	id := info.Type + "\x00" + key
+	b := bt.batches[id]
+	if b == nil {
+		b = &batch{
+			key:        key,
+			interfaces: make(map[string]bool),
+			protocols:  make(map[string]bool),
+		}
+		bt.batches[id] = b
+
+		time.AfterFunc(bt.timeout, func() {
+			bt.mu.Lock()
+			defer bt.mu.Unlock()
+
+			// The batch may have been published already
+			if bt.batches[id] == b {
+				delete(bt.batches, id)
+				bt.flush(b)
+			}
+		})
+	}
+
+	b.add(record, info)
+	if len(b.records) >= bt.size {
+		delete(bt.batches, id)
+		bt.flush(b)
+	}
+}
+
+// close publishes every pending batch.
+func (bt *batcher) close() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	for id, b := range bt.batches {
+		delete(bt.batches, id)
+		bt.flush(b)
+	}
+}
+
+// compress compresses a message body, returning its content encoding.
+func compress(body []byte, compression string) ([]byte, string, error) {
+	if compression != compressionGzip {
+		return body, "", nil
+	}
+
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return b.Bytes(), compressionGzip, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kbrebanov/nose-bleed/pcapng"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// Number of captured packets buffered between the capture goroutines and
+// the parse/publish pipeline
+const packetQueueLen = 1024
+
+// Time given to the backends on shutdown to hand over the packets they
+// buffer, such as AF_PACKET blocks not yet retired, before the captures
+// are closed
+const shutdownDrainTime = 500 * time.Millisecond
+
+// capturedPacket is a packet captured on one of the sniffed interfaces
+type capturedPacket struct {
+	packet  gopacket.Packet
+	ifIndex int
+}
+
+// captureDevice is a device to sniff. Optional devices, found by expanding
+// any, are skipped if the capture cannot be started.
+type captureDevice struct {
+	name     string
+	optional bool
+}
+
+// liveCapture is a live capture on a single interface
+type liveCapture struct {
+	device  string
+	handles []captureHandle
+	// Writer of the raw packets and index of the interface in it, if any
+	writer  *pcapWriter
+	wrIndex int
+	// Counters kept when the handles are closed
+	closed     bool
+	finalStats captureStats
+	finalErr   error
+}
+
+// stats returns the sum of the counters of the capture handles.
+func (c *liveCapture) stats() (captureStats, error) {
+	if c.closed {
+		return c.finalStats, c.finalErr
+	}
+
+	var total captureStats
+
+	for _, h := range c.handles {
+		stats, err := h.Stats()
+		if err != nil {
+			return total, err
+		}
+		total.Received += stats.Received
+		total.Dropped += stats.Dropped
+		total.IfDropped += stats.IfDropped
+	}
+
+	return total, nil
+}
+
+// close keeps the final counters of the capture and closes its handles,
+// which makes their packet sources end. Closing twice does nothing.
+func (c *liveCapture) close() {
+	if c.closed {
+		return
+	}
+
+	c.finalStats, c.finalErr = c.stats()
+	c.closed = true
+	for _, h := range c.handles {
+		h.Close()
+	}
+}
+
+// captureDevices expands a comma separated list of devices. The special
+// device any expands to every device found by pcap.
+func captureDevices(spec string) ([]captureDevice, error) {
+	var devices []captureDevice
+
+	for _, device := range strings.Split(spec, ",") {
+		device = strings.TrimSpace(device)
+		if device == "" {
+			continue
+		}
+
+		if device != "any" {
+			devices = append(devices, captureDevice{name: device})
+			continue
+		}
+
+		ifs, err := pcap.FindAllDevs()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range ifs {
+			// Skip the pseudo-device, every device is captured on its own
+			if iface.Name != "any" {
+				devices = append(devices, captureDevice{name: iface.Name, optional: true})
+			}
+		}
+	}
+
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no devices in %q", spec)
+	}
+
+	return devices, nil
+}
+
+// newPCAPWriters creates the writers of the raw packets of the captures.
+// All interfaces share a single pcapng writer, while each interface gets
+// its own pcap writer. The writers created before an error are returned
+// with it so that they can be closed.
+func newPCAPWriters(opts pcapWriteOptions, captures []*liveCapture, snapshotLen int) ([]*pcapWriter, error) {
+	var writers []*pcapWriter
+
+	iface := func(c *liveCapture) pcapng.Interface {
+		return pcapng.Interface{
+			Name:     c.device,
+			LinkType: c.handles[0].LinkType(),
+			SnapLen:  uint32(snapshotLen),
+		}
+	}
+
+	if opts.Format == formatPCAPNG {
+		names := make([]string, 0, len(captures))
+		interfaces := make([]pcapng.Interface, 0, len(captures))
+		for _, c := range captures {
+			names = append(names, c.device)
+			interfaces = append(interfaces, iface(c))
+		}
+
+		pw, err := newPCAPWriter(opts, strings.Join(names, "+"), interfaces)
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range captures {
+			c.writer = pw
+			c.wrIndex = i
+		}
+		pw.stats = func(ifIndex int) (captureStats, error) {
+			return captures[ifIndex].stats()
+		}
+
+		return append(writers, pw), nil
+	}
+
+	for _, c := range captures {
+		pw, err := newPCAPWriter(opts, c.device, []pcapng.Interface{iface(c)})
+		if err != nil {
+			return writers, err
+		}
+		c.writer = pw
+		writers = append(writers, pw)
+	}
+
+	return writers, nil
+}
+
+// sniff starts a live capture of network packets on each device, parses and
+// outputs the JSON results to either standard output or a RabbitMQ exchange.
+// Every capture handle is read in its own goroutine, feeding a shared pipeline.
+// A stats record is sent every statsInterval, if positive, and at the end.
+// When stop is closed, the captures are closed after shutdownDrainTime and
+// the packets already captured are output before sniff returns. They are
+// closed at once when one of the limits is reached.
+func sniff(devices []captureDevice, opts captureOptions, writeOpts pcapWriteOptions,
+	statsInterval time.Duration, limits captureLimits, settings *Settings, stop <-chan struct{}) error {
+	out, err := newOutput(settings)
+	if err != nil {
+		return err
+	}
+	defer out.close()
+
+	// Start a live capture on each device
+	var captures []*liveCapture
+	defer func() {
+		for _, c := range captures {
+			c.close()
+		}
+	}()
+	for _, device := range devices {
+		handles, err := openLive(device.name, len(captures), opts)
+		if err != nil && device.optional {
+			log.Println("Skipping device", device.name+":", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to start packet capture on %s: %v", device.name, err)
+		}
+
+		captures = append(captures, &liveCapture{device: device.name, handles: handles})
+	}
+	if len(captures) == 0 {
+		return fmt.Errorf("failed to start packet capture: no device could be opened")
+	}
+
+	// Write raw packets to pcap files
+	if writeOpts.Dir != "" {
+		writers, err := newPCAPWriters(writeOpts, captures, opts.SnapLen)
+		for _, pw := range writers {
+			defer func(pw *pcapWriter) {
+				if err := pw.close(); err != nil {
+					log.Println("Failed to close pcap file:", err)
+				}
+			}(pw)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create pcap writer: %v", err)
+		}
+	}
+
+	packets := make(chan capturedPacket, packetQueueLen)
+
+	var wg sync.WaitGroup
+	for i, c := range captures {
+		for _, h := range c.handles {
+			wg.Add(1)
+			go func(ifIndex int, h captureHandle) {
+				defer wg.Done()
+
+				packetSource := gopacket.NewPacketSource(h, h.LinkType())
+				for packet := range packetSource.Packets() {
+					packets <- capturedPacket{packet: packet, ifIndex: ifIndex}
+				}
+			}(i, h)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(packets)
+	}()
+
+	// Send periodic stats records from the pipeline, which owns the output
+	var tick <-chan time.Time
+	if statsInterval > 0 {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var deadline <-chan time.Time
+	if limits.Duration > 0 {
+		timer := time.NewTimer(limits.Duration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	lim := newLimiter(limits, time.Now())
+
+	closeCaptures := func() {
+		for _, c := range captures {
+			c.close()
+		}
+	}
+
+	// Parse each packet
+	var summary captureSummary
+	var drained <-chan time.Time
+	for {
+		select {
+		case cp, ok := <-packets:
+			if !ok {
+				sendStats(captures, &summary, out, true)
+				log.Printf("Captured %d packets on %d devices (%d parsed, %d failed)",
+					summary.Read, len(captures), summary.Parsed, summary.Failed)
+				fmt.Fprintf(os.Stderr, "Captured %d packets on %d devices (%d parsed, %d failed)\n",
+					summary.Read, len(captures), summary.Parsed, summary.Failed)
+				return nil
+			}
+			if !lim.allow(cp.packet) {
+				closeCaptures()
+				continue
+			}
+			handleCapturedPacket(cp, captures, out, &summary)
+			if lim.done() {
+				closeCaptures()
+			}
+		case <-deadline:
+			lim.announce("duration")
+			closeCaptures()
+		case <-tick:
+			sendStats(captures, &summary, out, false)
+		case <-stop:
+			drained = time.After(shutdownDrainTime)
+			stop = nil
+		case <-drained:
+			// Closing the handles ends the packet sources, the packets
+			// still queued are drained until the channel is closed
+			closeCaptures()
+			drained = nil
+		}
+	}
+}
+
+// handleCapturedPacket writes a live packet to its pcap file, if any, and
+// parses and outputs it with the interface it was captured on.
+func handleCapturedPacket(cp capturedPacket, captures []*liveCapture, out *output, summary *captureSummary) {
+	c := captures[cp.ifIndex]
+	extra := map[string]interface{}{
+		"interface": c.device,
+	}
+
+	// Tie the record to the packet in the pcap file
+	if c.writer != nil {
+		pcapFile, pcapIndex, err := c.writer.write(cp.packet, c.wrIndex)
+		if err != nil {
+			log.Println("Failed to write packet to pcap file:", err)
+		} else {
+			extra["pcap_file"] = pcapFile
+			extra["pcap_index"] = pcapIndex
+		}
+	}
+
+	handlePacket(cp.packet, extra, out, summary)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// filterCondition is a condition on a field of a record. An empty op tests
+// that the field is present and ! that it is missing.
+type filterCondition struct {
+	path  []string
+	op    string
+	value string
+}
+
+// displayFilter holds conditions that must all match for a record to be
+// shown
+type displayFilter []filterCondition
+
+// parseDisplayFilter parses conditions separated by &&, such as
+// "dns && udp.destination_port == 53 && ipv4.protocol != TCP".
+func parseDisplayFilter(expr string) (displayFilter, error) {
+	var filter displayFilter
+
+	if strings.TrimSpace(expr) == "" {
+		return filter, nil
+	}
+
+	for _, term := range strings.Split(expr, "&&") {
+		term = strings.TrimSpace(term)
+
+		var cond filterCondition
+		field := term
+		// The first operator splits the term, so values may hold one
+		i, op := strings.Index(term, "=="), "=="
+		if ne := strings.Index(term, "!="); ne >= 0 && (i < 0 || ne < i) {
+			i, op = ne, "!="
+		}
+		if i >= 0 {
+			cond.op = op
+			field = strings.TrimSpace(term[:i])
+			cond.value = unquote(strings.TrimSpace(term[i+2:]))
+		} else if strings.HasPrefix(term, "!") {
+			cond.op = "!"
+			field = strings.TrimSpace(term[1:])
+		}
+
+		if !routingKeyField.MatchString("." + field) {
+			return nil, fmt.Errorf("invalid field %q in display filter", field)
+		}
+		cond.path = strings.Split(field, ".")
+		filter = append(filter, cond)
+	}
+
+	return filter, nil
+}
+
+// unquote removes the double quotes around a value, if any.
+func unquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// match reports whether a decoded record matches every condition.
+func (f displayFilter) match(fields map[string]interface{}) bool {
+	for _, cond := range f {
+		switch cond.op {
+		case "":
+			if fieldValue(fields, cond.path) == nil {
+				return false
+			}
+		case "!":
+			if fieldValue(fields, cond.path) != nil {
+				return false
+			}
+		case "==":
+			if value, ok := lookupField(fields, cond.path); !ok || value != cond.value {
+				return false
+			}
+		case "!=":
+			if value, ok := lookupField(fields, cond.path); ok && value == cond.value {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// deliveryRecords unpacks the records of a message, which may be a batch
+// and be compressed.
+func deliveryRecords(d amqp.Delivery) ([]map[string]interface{}, error) {
+	body := d.Body
+
+	switch d.ContentEncoding {
+	case "":
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		body, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	case compressionZstd:
+		// No zstd decoder is vendored
+		return nil, fmt.Errorf("zstd content encoding is not supported by this build")
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", d.ContentEncoding)
+	}
+
+	var records []map[string]interface{}
+	d2 := json.NewDecoder(bytes.NewReader(body))
+	// Keep numbers as they were marshalled
+	d2.UseNumber()
+
+	// A batch is either a JSON array or newline delimited JSON
+	if _, batch := d.Headers["record_count"]; batch && bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		if err := d2.Decode(&records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	for {
+		var record map[string]interface{}
+		if err := d2.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// deliveryInfo returns the record info carried by the properties of a
+// message.
+func deliveryInfo(d amqp.Delivery) recordInfo {
+	info := recordInfo{
+		Type:      d.Type,
+		Timestamp: d.Timestamp,
+	}
+	if iface, ok := d.Headers["interface"].(string); ok {
+		info.Interface = iface
+	}
+	if protocols, ok := d.Headers["protocols"].(string); ok && protocols != "" {
+		info.Protocols = strings.Split(protocols, ",")
+	}
+
+	return info
+}
+
+// consume implements the consume command, reading the records published to
+// the exchange through a temporary queue and showing them, writing them to
+// a file as newline delimited JSON or sending them to another output.
+func consume(args []string) int {
+	flags := flag.NewFlagSet("consume", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to configuration file in JSON format with the RabbitMQ settings")
+	key := flags.String("key", "", "Routing key pattern to bind the temporary queue with (default # for topic exchanges, otherwise the publish key)")
+	filter := flags.String("filter", "", `Display filter, such as "dns && udp.destination_port == 53"`)
+	outputPath := flags.String("output", "", "File to append the records to as newline delimited JSON, - for standard output")
+	sinkConfigPath := flags.String("sink-config", "", "Path to configuration file of another output to send the records to")
+	count := flags.Int("count", 0, "Exit after this many records (0 for unlimited)")
+	flags.Parse(args)
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Failed to consume: -config is required")
+		return exitFailure
+	}
+	settings, err := readSettings(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get settings:", err)
+		return exitFailure
+	}
+
+	display, err := parseDisplayFilter(*filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to parse display filter:", err)
+		return exitFailure
+	}
+
+	// Records are shown on standard output unless sent elsewhere
+	var out *output
+	var w *bufio.Writer
+	switch {
+	case *sinkConfigPath != "":
+		sinkSettings, err := readSettings(*sinkConfigPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to get sink settings:", err)
+			return exitFailure
+		}
+		out, err = newOutput(sinkSettings)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create sink:", err)
+			return exitFailure
+		}
+	case *outputPath == "-":
+		w = bufio.NewWriter(os.Stdout)
+	case *outputPath != "":
+		f, err := os.OpenFile(*outputPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open output file:", err)
+			return exitFailure
+		}
+		defer f.Close()
+		w = bufio.NewWriter(f)
+	default:
+		out, _ = newOutput(new(Settings))
+	}
+	if out != nil {
+		defer out.close()
+	}
+	if w != nil {
+		defer w.Flush()
+	}
+
+	tlsConfig, err := rabbitMQTLSConfig(settings.RabbitMQ)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to consume:", err)
+		return exitFailure
+	}
+
+	conn, err := dial(settings.RabbitMQ, tlsConfig, rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to consume:", err)
+		return exitFailure
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open a channel:", err)
+		return exitFailure
+	}
+
+	// The temporary queue is deleted when the connection closes
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to declare a queue:", err)
+		return exitFailure
+	}
+	if *key == "" {
+		*key = settings.RabbitMQ.Publish.Key
+		if settings.RabbitMQ.Exchange.Type == "topic" {
+			*key = "#"
+		}
+	}
+	if err := ch.QueueBind(queue.Name, *key, settings.RabbitMQ.Exchange.Name, false, nil); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to bind queue:", err)
+		return exitFailure
+	}
+
+	deliveries, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to consume:", err)
+		return exitFailure
+	}
+
+	stop := handleSignals()
+	consumed := 0
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				fmt.Fprintln(os.Stderr, "Failed to consume: channel closed")
+				return exitFailure
+			}
+
+			records, err := deliveryRecords(d)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to decode message:", err)
+				continue
+			}
+
+			info := deliveryInfo(d)
+			for _, record := range records {
+				if !display.match(record) {
+					continue
+				}
+
+				if w != nil {
+					b, err := json.Marshal(record)
+					if err != nil {
+						fmt.Fprintln(os.Stderr, "Failed to marshal record to JSON:", err)
+						continue
+					}
+					w.Write(b)
+					w.WriteByte('\n')
+				} else {
+					out.send(record, info)
+				}
+
+				consumed++
+				if *count > 0 && consumed >= *count {
+					return exitSuccess
+				}
+			}
+			if w != nil && len(deliveries) == 0 {
+				w.Flush()
+			}
+		case <-stop:
+			return exitSuccess
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDisplayFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		want displayFilter
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"dns", displayFilter{{path: []string{"dns"}}}},
+		{"!tcp", displayFilter{{path: []string{"tcp"}, op: "!"}}},
+		{"! ipv6.extension_headers", displayFilter{{path: []string{"ipv6", "extension_headers"}, op: "!"}}},
+		{"udp.destination_port == 53", displayFilter{{path: []string{"udp", "destination_port"}, op: "==", value: "53"}}},
+		{"ipv4.protocol!=TCP", displayFilter{{path: []string{"ipv4", "protocol"}, op: "!=", value: "TCP"}}},
+		{`dns.questions == "a b"`, displayFilter{{path: []string{"dns", "questions"}, op: "==", value: "a b"}}},
+		{`hostname != "a==b"`, displayFilter{{path: []string{"hostname"}, op: "!=", value: "a==b"}}},
+		{`hostname == "a!=b"`, displayFilter{{path: []string{"hostname"}, op: "==", value: "a!=b"}}},
+		{`hostname == ""`, displayFilter{{path: []string{"hostname"}, op: "==", value: ""}}},
+		{`hostname == "`, displayFilter{{path: []string{"hostname"}, op: "==", value: `"`}}},
+		{"dns && !tcp && udp.source_port != 53", displayFilter{
+			{path: []string{"dns"}},
+			{path: []string{"tcp"}, op: "!"},
+			{path: []string{"udp", "source_port"}, op: "!=", value: "53"},
+		}},
+	}
+
+	for _, test := range tests {
+		got, err := parseDisplayFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestParseDisplayFilterErrors(t *testing.T) {
+	tests := []string{
+		"dns &&",
+		"== 53",
+		"!",
+		"!udp.port == 53",
+		"udp..port",
+		"udp.port = 53",
+	}
+
+	for _, expr := range tests {
+		if _, err := parseDisplayFilter(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestDisplayFilterMatch(t *testing.T) {
+	fields := map[string]interface{}{
+		"dns":  map[string]interface{}{"id": 7},
+		"udp":  map[string]interface{}{"destination_port": "53"},
+		"tcp":  nil,
+		"name": "a b",
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"dns", true},
+		{"tcp", false},
+		{"!tcp", true},
+		{"!dns", false},
+		{"udp.destination_port == 53", true},
+		{"udp.destination_port == 54", false},
+		{"udp.destination_port != 54", true},
+		{"udp.destination_port != 53", false},
+		{"ipv4.protocol != TCP", true},
+		{"ipv4.protocol == TCP", false},
+		{"dns != x", true},
+		{`name == "a b"`, true},
+		{"dns && udp.destination_port == 53 && !tcp", true},
+		{"dns && udp.destination_port == 53 && tcp", false},
+	}
+
+	for _, test := range tests {
+		filter, err := parseDisplayFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.expr, err)
+			continue
+		}
+		if got := filter.match(fields); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
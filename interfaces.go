@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// interfaceAddress is an address of a capture interface
+type interfaceAddress struct {
+	IP           string `json:"ip"`
+	Netmask      string `json:"netmask,omitempty"`
+	PrefixLength *int   `json:"prefix_length,omitempty"`
+}
+
+// interfaceLinkType is a link type supported by a capture interface
+type interfaceLinkType struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// captureInterface describes an interface that can be given to -device
+type captureInterface struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	Addresses   []interfaceAddress  `json:"addresses"`
+	Flags       []string            `json:"flags"`
+	LinkTypes   []interfaceLinkType `json:"link_types"`
+	// LinkTypesError explains why the link types could not be listed,
+	// typically for lack of privileges
+	LinkTypesError string `json:"link_types_error,omitempty"`
+}
+
+// findInterfaces describes every interface found by pcap.
+func findInterfaces() ([]captureInterface, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := make([]captureInterface, 0, len(devs))
+	for _, dev := range devs {
+		iface := captureInterface{
+			Name:        dev.Name,
+			Description: dev.Description,
+			Addresses:   make([]interfaceAddress, 0, len(dev.Addresses)),
+			Flags:       make([]string, 0),
+			LinkTypes:   make([]interfaceLinkType, 0),
+		}
+
+		for _, addr := range dev.Addresses {
+			a := interfaceAddress{IP: addr.IP.String()}
+			if addr.Netmask != nil {
+				a.Netmask = net.IP(addr.Netmask).String()
+				if ones, bits := addr.Netmask.Size(); bits != 0 {
+					a.PrefixLength = &ones
+				}
+			}
+			iface.Addresses = append(iface.Addresses, a)
+		}
+
+		// pcap does not report flags, take them from the operating system
+		if netIface, err := net.InterfaceByName(dev.Name); err == nil && netIface.Flags != 0 {
+			iface.Flags = strings.Split(netIface.Flags.String(), "|")
+		}
+
+		// Listing the link types needs a capture handle
+		handle, err := pcap.OpenLive(dev.Name, 64, false, pcap.BlockForever)
+		if err != nil {
+			iface.LinkTypesError = err.Error()
+		} else {
+			datalinks, err := handle.ListDataLinks()
+			if err != nil {
+				iface.LinkTypesError = err.Error()
+			}
+			for _, dl := range datalinks {
+				iface.LinkTypes = append(iface.LinkTypes, interfaceLinkType{
+					Name:        dl.Name,
+					Description: dl.Description,
+				})
+			}
+			handle.Close()
+		}
+
+		interfaces = append(interfaces, iface)
+	}
+
+	return interfaces, nil
+}
+
+// listInterfaces implements the list-interfaces command, printing the
+// capture interfaces as a table or as JSON, and returns the exit status.
+func listInterfaces(args []string) int {
+	flags := flag.NewFlagSet("list-interfaces", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the interfaces as JSON")
+	flags.Parse(args)
+
+	interfaces, err := findInterfaces()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to find interfaces:", err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(interfaces, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to marshal interfaces to JSON:", err)
+			return exitFailure
+		}
+		fmt.Println(string(b))
+		return exitSuccess
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDESCRIPTION\tADDRESSES\tFLAGS\tLINK TYPES")
+	for _, iface := range interfaces {
+		addresses := make([]string, 0, len(iface.Addresses))
+		for _, a := range iface.Addresses {
+			if a.PrefixLength != nil {
+				addresses = append(addresses, fmt.Sprintf("%s/%d", a.IP, *a.PrefixLength))
+			} else {
+				addresses = append(addresses, a.IP)
+			}
+		}
+
+		linkTypes := make([]string, 0, len(iface.LinkTypes))
+		for _, lt := range iface.LinkTypes {
+			linkTypes = append(linkTypes, lt.Name)
+		}
+		if iface.LinkTypesError != "" {
+			linkTypes = append(linkTypes, "?")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", iface.Name, dash(iface.Description),
+			dash(strings.Join(addresses, ",")), dash(strings.Join(iface.Flags, ",")),
+			dash(strings.Join(linkTypes, ",")))
+	}
+	w.Flush()
+
+	return exitSuccess
+}
+
+// dash returns s, or a dash if s is empty, for table cells.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// captureLimits bounds a capture or a read of capture files. Zero values
+// disable a limit.
+type captureLimits struct {
+	// Count is the maximum number of packets
+	Count int
+	// Duration is the maximum time between the start of a live capture, or
+	// the first packet of the files read, and the timestamp of a packet
+	Duration time.Duration
+	// MaxBytes is the maximum number of captured bytes
+	MaxBytes int64
+}
+
+// limiter counts the packets handled against the capture limits.
+type limiter struct {
+	limits  captureLimits
+	start   time.Time
+	packets int
+	bytes   int64
+	reached bool
+	// announced reports whether reaching a limit has been logged
+	announced bool
+}
+
+// newLimiter returns a limiter measuring the duration from start, or from
+// the timestamp of the first packet if start is zero.
+func newLimiter(limits captureLimits, start time.Time) *limiter {
+	return &limiter{limits: limits, start: start}
+}
+
+// allow reports whether a packet is within the limits, counting it if so.
+// Once a packet is refused, or the packet count is reached, every later
+// packet is refused.
+func (l *limiter) allow(packet gopacket.Packet) bool {
+	if l.reached {
+		return false
+	}
+
+	ci := packet.Metadata().CaptureInfo
+	if l.start.IsZero() {
+		l.start = ci.Timestamp
+	}
+
+	if l.limits.Duration > 0 && ci.Timestamp.Sub(l.start) >= l.limits.Duration {
+		l.stop("duration")
+		return false
+	}
+	if l.limits.MaxBytes > 0 && l.bytes+int64(ci.CaptureLength) > l.limits.MaxBytes {
+		l.stop("byte")
+		return false
+	}
+
+	l.packets++
+	l.bytes += int64(ci.CaptureLength)
+
+	if l.limits.Count > 0 && l.packets >= l.limits.Count {
+		l.stop("packet count")
+	}
+
+	return true
+}
+
+// done reports whether a limit has been reached.
+func (l *limiter) done() bool {
+	return l.reached
+}
+
+// stop marks a limit as reached.
+func (l *limiter) stop(limit string) {
+	l.announce(limit)
+	l.reached = true
+}
+
+// announce logs that a limit is reached, once. It is used on its own when
+// the duration of a live capture ends, as the packets already captured are
+// still within the limit.
+func (l *limiter) announce(limit string) {
+	if !l.announced {
+		log.Println("Reached the", limit, "limit, stopping")
+		l.announced = true
+	}
+}
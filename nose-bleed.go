@@ -1,14 +1,18 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/kbrebanov/nose-bleed/parser"
@@ -20,12 +24,26 @@ import (
 
 const version string = "0.5.0"
 
+// Application id of the published messages
+const appID = "nose-bleed"
+
+// Record types, used as the type of the published messages
+const (
+	recordPacket              = "packet"
+	recordStats               = "stats"
+	recordInterfaceStatistics = "interface_statistics"
+)
+
 // RabbitMQPublishSettings is a structure for RabbitMQ publish settings
 type RabbitMQPublishSettings struct {
-	Key        string `json:"key"`
-	Mandatory  bool   `json:"mandatory"`
-	Immediate  bool   `json:"immediate"`
-	Persistent bool   `json:"persistent"`
+	Key         string `json:"key"`
+	KeyFallback string `json:"key_fallback"`
+	Mandatory   bool   `json:"mandatory"`
+	Immediate   bool   `json:"immediate"`
+	Persistent  bool   `json:"persistent"`
+	Confirm     bool   `json:"confirm"`
+	MaxInFlight int    `json:"max_in_flight"`
+	MaxRetries  *int   `json:"max_retries"`
 }
 
 // RabbitMQExchangeSettings is a structure for RabbitMQ exchange settings
@@ -40,22 +58,72 @@ type RabbitMQExchangeSettings struct {
 
 // RabbitMQTLSSettings is a structure for RabbitMQ TLS settings
 type RabbitMQTLSSettings struct {
-	Enabled    bool   `json:"enabled"`
-	CACertFile string `json:"ca_cert_file"`
-	CertFile   string `json:"cert_file"`
-	KeyFile    string `json:"key_file"`
+	Enabled            bool     `json:"enabled"`
+	CACertFile         string   `json:"ca_cert_file"`
+	CertFile           string   `json:"cert_file"`
+	KeyFile            string   `json:"key_file"`
+	ServerName         string   `json:"server_name"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	MinVersion         string   `json:"min_version"`
+	CipherSuites       []string `json:"cipher_suites"`
+	PinnedSPKISHA256   []string `json:"pinned_spki_sha256"`
+}
+
+// RabbitMQReconnectSettings is a structure for RabbitMQ reconnect settings
+type RabbitMQReconnectSettings struct {
+	InitialIntervalMS int `json:"initial_interval_ms"`
+	MaxIntervalMS     int `json:"max_interval_ms"`
+}
+
+// RabbitMQBufferSettings is a structure for the settings of the buffer of
+// records waiting to be published
+type RabbitMQBufferSettings struct {
+	Size           int    `json:"size"`
+	DropPolicy     string `json:"drop_policy"`
+	FlushTimeoutMS int    `json:"flush_timeout_ms"`
+}
+
+// RabbitMQBatchSettings is a structure for the settings of the batches of
+// records published as one message
+type RabbitMQBatchSettings struct {
+	Size        int    `json:"size"`
+	TimeoutMS   int    `json:"timeout_ms"`
+	Format      string `json:"format"`
+	Compression string `json:"compression"`
+}
+
+// RabbitMQQueueSettings is a structure for the settings of a RabbitMQ queue
+// bound to the exchange
+type RabbitMQQueueSettings struct {
+	Name                 string   `json:"name"`
+	Durable              bool     `json:"durable"`
+	AutoDelete           bool     `json:"auto_delete"`
+	MessageTTLMS         int64    `json:"message_ttl_ms"`
+	MaxLength            int64    `json:"max_length"`
+	MaxLengthBytes       int64    `json:"max_length_bytes"`
+	Overflow             string   `json:"overflow"`
+	DeadLetterExchange   string   `json:"dead_letter_exchange"`
+	DeadLetterRoutingKey string   `json:"dead_letter_routing_key"`
+	BindingKeys          []string `json:"binding_keys"`
 }
 
 // RabbitMQSettings is a structure for RabbitMQ settings
 type RabbitMQSettings struct {
-	User     string                   `json:"user"`
-	Password string                   `json:"password"`
-	Host     string                   `json:"host"`
-	Port     int                      `json:"port"`
-	VHost    string                   `json:"vhost"`
-	TLS      RabbitMQTLSSettings      `json:"tls"`
-	Exchange RabbitMQExchangeSettings `json:"exchange"`
-	Publish  RabbitMQPublishSettings  `json:"publish"`
+	URIs      []string                  `json:"uris"`
+	User      string                    `json:"user"`
+	Password  string                    `json:"password"`
+	Host      string                    `json:"host"`
+	Hosts     []string                  `json:"hosts"`
+	HostOrder string                    `json:"host_order"`
+	Port      int                       `json:"port"`
+	VHost     string                    `json:"vhost"`
+	TLS       RabbitMQTLSSettings       `json:"tls"`
+	Exchange  RabbitMQExchangeSettings  `json:"exchange"`
+	Publish   RabbitMQPublishSettings   `json:"publish"`
+	Reconnect RabbitMQReconnectSettings `json:"reconnect"`
+	Buffer    RabbitMQBufferSettings    `json:"buffer"`
+	Batch     RabbitMQBatchSettings     `json:"batch"`
+	Queues    []RabbitMQQueueSettings   `json:"queues"`
 }
 
 // Settings is a structure for configuration settings
@@ -63,177 +131,471 @@ type Settings struct {
 	RabbitMQ RabbitMQSettings `json:"rabbitmq,omitempty"`
 }
 
-// RabbitMQ error handler
-func failOnError(err error, msg string) {
+// readSettings reads settings from a configuration file in JSON format,
+// resolving the secrets taken from environment variables and files. A
+// configuration with problems is an error.
+func readSettings(path string) (*Settings, error) {
+	s, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("%s: %s", msg, err)
+		return nil, err
+	}
+
+	settings, problems, err := validateSettings(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, configError(problems)
 	}
+
+	return settings, nil
 }
 
-// sniff starts a live capture of network packets, parses and outputs
-// the JSON results to either standard output or a RabbitMQ exchange.
-func sniff(deviceName string, snapshotLen int, promiscuous bool, timeout time.Duration,
-	filter string, settings *Settings) {
+// output sends parsed packet headers to either standard output or a
+// RabbitMQ exchange.
+type output struct {
+	// Sequence of the message ids, updated atomically as batches are
+	// published from their timers
+	messageID uint64
+
+	settings    *Settings
+	useRabbitMQ bool
+	pub         *publisher
+	key         *routingKey
+	batches     *batcher
+
+	// Host name sent in the message headers and prefix of the message ids
+	hostname string
+	idPrefix string
+
+	// Number of records that failed to be marshalled
+	marshalFailures uint64
+}
 
-	var ch *amqp.Channel
-	var conn *amqp.Connection
-	var vhost string
+// recordInfo describes a record in the properties of its message
+type recordInfo struct {
+	Type      string
+	Timestamp time.Time
+	// Interface and top-level protocols of a packet, if any
+	Interface string
+	Protocols []string
+}
 
-	useRabbitMQ := false
+// newOutput creates an output, connecting to RabbitMQ and declaring the
+// exchange if it is configured in the settings.
+func newOutput(settings *Settings) (*output, error) {
+	out := &output{settings: settings}
 
-	if settings.RabbitMQ.User != "" && settings.RabbitMQ.Password != "" && settings.RabbitMQ.Host != "" &&
-		settings.RabbitMQ.Exchange.Name != "" && settings.RabbitMQ.Exchange.Type != "" {
-		useRabbitMQ = true
+	out.useRabbitMQ = rabbitMQEnabled(settings.RabbitMQ)
+	if !out.useRabbitMQ {
+		return out, nil
 	}
 
-	if settings.RabbitMQ.VHost == "" {
-		vhost = "/"
-	} else {
-		vhost = "/" + settings.RabbitMQ.VHost
+	var err error
+	out.hostname, err = os.Hostname()
+	if err != nil {
+		log.Println("Failed to get host name:", err)
+	}
+
+	// Message ids are unique across restarts thanks to a random prefix
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate message id prefix: %v", err)
+	}
+	out.idPrefix = hex.EncodeToString(prefix)
+
+	out.key, err = parseRoutingKey(settings.RabbitMQ.Publish.Key, settings.RabbitMQ.Publish.KeyFallback)
+	if err != nil {
+		return nil, err
+	}
+
+	// Batch records if more than one fits in a message
+	if settings.RabbitMQ.Batch.Size > 1 {
+		out.batches, err = newBatcher(settings.RabbitMQ.Batch, out.publishBatch)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Initialize msg queue
-	if useRabbitMQ {
-		if settings.RabbitMQ.TLS.Enabled {
-			tlsConfig := new(tls.Config)
-			tlsConfig.RootCAs = x509.NewCertPool()
+	out.pub, err = newPublisher(settings.RabbitMQ)
+	if err != nil {
+		return nil, err
+	}
 
-			if ca, err := ioutil.ReadFile(settings.RabbitMQ.TLS.CACertFile); err == nil {
-				tlsConfig.RootCAs.AppendCertsFromPEM(ca)
-			}
+	return out, nil
+}
 
-			if cert, err := tls.LoadX509KeyPair(settings.RabbitMQ.TLS.CertFile, settings.RabbitMQ.TLS.KeyFile); err == nil {
-				tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
-			}
+// send outputs a single record, such as the parsed headers of a packet.
+// Failures are logged and counted. Records sent to RabbitMQ are queued to
+// be published in the background, with message properties and headers
+// taken from info.
+func (out *output) send(record interface{}, info recordInfo) error {
+	if out.useRabbitMQ {
+		b, err := json.Marshal(record)
+		if err != nil {
+			log.Println("Failed to marshal record to JSON:", err)
+			out.marshalFailures++
+			return err
+		}
+
+		if out.batches != nil {
+			out.batches.add(out.key.expand(b), b, info)
+			return nil
+		}
 
-			var err error
-			conn, err = amqp.DialTLS(
-				fmt.Sprintf("amqps://%s:%s@%s%s",
-					settings.RabbitMQ.User,
-					settings.RabbitMQ.Password,
-					fmt.Sprintf("%s:%d", settings.RabbitMQ.Host, settings.RabbitMQ.Port),
-					vhost),
-				tlsConfig)
-			failOnError(err, "Failed to connect to RabbitMQ using TLS")
-			defer conn.Close()
-		} else {
-			var err error
-			conn, err = amqp.Dial(
-				fmt.Sprintf("amqp://%s:%s@%s%s",
-					settings.RabbitMQ.User,
-					settings.RabbitMQ.Password,
-					fmt.Sprintf("%s:%d", settings.RabbitMQ.Host, settings.RabbitMQ.Port),
-					vhost))
-			failOnError(err, "Failed to connect to RabbitMQ")
-			defer conn.Close()
+		out.pub.publish(out.key.expand(b), out.message(b, "application/json", "", info))
+	} else {
+		// Pretty print JSON when sending to standard output
+		b, err := json.MarshalIndent(record, "", "  ")
+		if err != nil {
+			log.Println("Failed to marshal record to JSON:", err)
+			out.marshalFailures++
+			return err
 		}
+		fmt.Println(string(b))
+		fmt.Println()
+	}
+
+	return nil
+}
 
-		var err error
+// message returns the message of a body with its properties.
+func (out *output) message(body []byte, contentType, contentEncoding string, info recordInfo) amqp.Publishing {
+	// Set message to be non-persistent by default
+	var deliveryMode uint8 = 1
 
-		// Create a channel
-		ch, err = conn.Channel()
-		failOnError(err, "Failed to open a channel")
-		defer ch.Close()
+	if out.settings.RabbitMQ.Publish.Persistent {
+		deliveryMode = 2
+	}
 
-		// Declare an exchange
-		err = ch.ExchangeDeclare(
-			settings.RabbitMQ.Exchange.Name,
-			settings.RabbitMQ.Exchange.Type,
-			settings.RabbitMQ.Exchange.Durable,
-			settings.RabbitMQ.Exchange.AutoDelete,
-			settings.RabbitMQ.Exchange.Internal,
-			settings.RabbitMQ.Exchange.NoWait,
-			nil)
-		failOnError(err, "Failed to declare an exchange")
+	return amqp.Publishing{
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		DeliveryMode:    deliveryMode,
+		MessageId:       fmt.Sprintf("%s-%d", out.idPrefix, atomic.AddUint64(&out.messageID, 1)),
+		Timestamp:       info.Timestamp,
+		Type:            info.Type,
+		AppId:           appID,
+		Headers:         out.headers(info),
+		Body:            body,
 	}
+}
 
-	// Start a live capture
-	handle, err := pcap.OpenLive(deviceName, int32(snapshotLen), promiscuous, timeout)
+// publishBatch publishes a batch of records as one message, with the
+// number of records in its record_count header.
+func (out *output) publishBatch(b *batch) {
+	body, contentType := b.encode(out.batches.format)
+	body, contentEncoding, err := compress(body, out.batches.compression)
 	if err != nil {
-		log.Fatalln("Failed to start packet capture:", err)
+		log.Println("Failed to compress batch:", err)
+		return
 	}
-	defer handle.Close()
 
-	// Set filter
-	if filter != "" {
-		err = handle.SetBPFFilter(filter)
-		if err != nil {
-			log.Println("Failed to set BPF:", err)
+	msg := out.message(body, contentType, contentEncoding, b.mergedInfo())
+	msg.Headers["record_count"] = int32(len(b.records))
+	out.pub.publish(b.key, msg)
+}
+
+// headers returns the message headers of a record. Each protocol is also
+// sent as a protocol.<name> header so that a headers exchange can match it.
+func (out *output) headers(info recordInfo) amqp.Table {
+	headers := amqp.Table{
+		"version": version,
+	}
+	if out.hostname != "" {
+		headers["hostname"] = out.hostname
+	}
+	if info.Interface != "" {
+		headers["interface"] = info.Interface
+	}
+	if len(info.Protocols) > 0 {
+		headers["protocols"] = strings.Join(info.Protocols, ",")
+		for _, protocol := range info.Protocols {
+			headers["protocol."+protocol] = true
 		}
 	}
 
-	// Parse each packet
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	for packet := range packetSource.Packets() {
-		headers, err := parser.Parse(packet)
+	return headers
+}
+
+// publishCounters returns the counters of the RabbitMQ publisher.
+func (out *output) publishCounters() publishCounters {
+	if out.pub == nil {
+		return publishCounters{}
+	}
+	return out.pub.counters()
+}
+
+// close publishes the pending batches and the buffered records and closes
+// the RabbitMQ connection, if any.
+func (out *output) close() {
+	if out.batches != nil {
+		out.batches.close()
+	}
+	if out.pub != nil {
+		out.pub.close()
+	}
+}
+
+// captureSummary counts the packets handled from a packet source.
+type captureSummary struct {
+	Read   int
+	Parsed int
+	Failed int
+	// FailedByProtocol counts the parse failures of each protocol
+	FailedByProtocol map[string]int
+}
+
+// process parses each packet from a packet source and sends the results to
+// the output until the source is exhausted, a limit is reached or stop is
+// closed.
+func process(packetSource *gopacket.PacketSource, out *output, lim *limiter, stop <-chan struct{}) captureSummary {
+	var summary captureSummary
+
+	packets := packetSource.Packets()
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok || !lim.allow(packet) {
+				return summary
+			}
+			handlePacket(packet, nil, out, &summary)
+			if lim.done() {
+				return summary
+			}
+		case <-stop:
+			return summary
+		}
+	}
+}
+
+// handlePacket parses a single packet, adds the extra fields to its headers
+// and sends them to the output.
+func handlePacket(packet gopacket.Packet, extra map[string]interface{}, out *output, summary *captureSummary) {
+	summary.Read++
+
+	headers, err := parser.Parse(packet)
+	if err != nil {
+		log.Println("Failed to parse packet:", err, packet)
+		summary.Failed++
+
+		protocol := "unknown"
+		if parseErr, ok := err.(*parser.ParseError); ok {
+			protocol = parseErr.Protocol
+		}
+		if summary.FailedByProtocol == nil {
+			summary.FailedByProtocol = make(map[string]int)
+		}
+		summary.FailedByProtocol[protocol]++
+		return
+	}
+	summary.Parsed++
+
+	// The parsed headers are keyed by protocol, apart from the timestamp
+	info := recordInfo{
+		Type:      recordPacket,
+		Timestamp: packet.Metadata().Timestamp,
+	}
+	for key := range headers {
+		if key != "timestamp" {
+			info.Protocols = append(info.Protocols, key)
+		}
+	}
+	sort.Strings(info.Protocols)
+
+	for key, value := range extra {
+		headers[key] = value
+	}
+	if iface, ok := extra["interface"].(string); ok {
+		info.Interface = iface
+	}
+
+	out.send(headers, info)
+}
+
+// expandPaths expands a comma separated list of file paths and glob
+// patterns into the list of matching files.
+func expandPaths(paths string) ([]string, error) {
+	var files []string
+
+	for _, pattern := range strings.Split(paths, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
 		if err != nil {
-			log.Println("Failed to parse packet:", err, packet)
+			return nil, err
 		}
+		if matches == nil {
+			return nil, fmt.Errorf("no files match %q", pattern)
+		}
+		files = append(files, matches...)
+	}
 
-		if useRabbitMQ {
-			// Set message to be non-persistent by default
-			var deliveryMode uint8 = 1
+	return files, nil
+}
 
-			if settings.RabbitMQ.Publish.Persistent {
-				deliveryMode = 2
-			}
+// readFiles reads network packets from pcap or pcapng files, parses and
+// outputs the JSON results to either standard output or a RabbitMQ exchange.
+// Reading stops early when a limit is reached or stop is closed.
+func readFiles(files []string, filter string, limits captureLimits, settings *Settings, stop <-chan struct{}) error {
+	total := captureSummary{FailedByProtocol: make(map[string]int)}
 
-			b, err := json.Marshal(headers)
-			if err != nil {
-				log.Println("Failed to marshal packet to JSON:", err, packet)
-				// Skip packet if JSON marshalling errors
-				continue
-			}
-			// Send JSON to RabbitMQ exchange
-			err = ch.Publish(
-				settings.RabbitMQ.Exchange.Name,
-				settings.RabbitMQ.Publish.Key,
-				settings.RabbitMQ.Publish.Mandatory,
-				settings.RabbitMQ.Publish.Immediate,
-				amqp.Publishing{
-					ContentType:  "text/json",
-					DeliveryMode: deliveryMode,
-					Body:         b,
-				})
-			failOnError(err, "Failed to publish a message")
-		} else {
-			// Pretty print JSON when sending to standard output
-			b, err := json.MarshalIndent(headers, "", "  ")
-			if err != nil {
-				log.Println("Failed to marshal packet to JSON:", err, packet)
-				// Skip packet if JSON marshalling errors
-				continue
+	// Rather than output every packet, refuse filters that cannot be applied
+	if filter != "" {
+		for _, file := range files {
+			if ng, _ := isPCAPNG(file); ng {
+				return fmt.Errorf("BPF filters are not supported for pcapng files: %s", file)
 			}
-			fmt.Println(string(b))
-			fmt.Println()
 		}
 	}
+
+	out, err := newOutput(settings)
+	if err != nil {
+		return err
+	}
+	defer out.close()
+
+	// The duration is measured from the first packet read
+	lim := newLimiter(limits, time.Time{})
+
+	read, unreadable := 0, 0
+	for _, file := range files {
+		if stopped(stop) || lim.done() {
+			break
+		}
+
+		// A file that cannot be read is skipped, keeping any packets read
+		// before the error
+		var summary captureSummary
+		ng, err := isPCAPNG(file)
+		switch {
+		case err != nil:
+		case ng:
+			summary, err = readPCAPNG(file, out, lim, stop)
+		default:
+			summary, err = readPCAP(file, filter, out, lim, stop)
+		}
+		if err != nil {
+			log.Println("Failed to read capture file", file+":", err)
+			unreadable++
+		}
+		read++
+
+		log.Printf("Read %d packets from %s (%d parsed, %d failed)",
+			summary.Read, file, summary.Parsed, summary.Failed)
+
+		total.Read += summary.Read
+		total.Parsed += summary.Parsed
+		total.Failed += summary.Failed
+		for protocol, failures := range summary.FailedByProtocol {
+			total.FailedByProtocol[protocol] += failures
+		}
+	}
+
+	// Files have no capture counters, only the pipeline ones are sent
+	sendStats(nil, &total, out, true)
+
+	message := fmt.Sprintf("Read %d packets from %d files (%d parsed, %d failed)",
+		total.Read, read, total.Parsed, total.Failed)
+	if unreadable > 0 {
+		message += fmt.Sprintf(", %d of which could not be read", unreadable)
+	}
+	log.Println(message)
+	fmt.Fprintln(os.Stderr, message)
+
+	return nil
+}
+
+// readPCAP reads the packets of a pcap file using libpcap.
+func readPCAP(file string, filter string, out *output, lim *limiter, stop <-chan struct{}) (captureSummary, error) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return captureSummary{}, err
+	}
+	defer handle.Close()
+
+	// Set filter
+	if filter != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			return captureSummary{}, fmt.Errorf("failed to set BPF: %v", err)
+		}
+	}
+
+	// Parse each packet until the end of the file
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	return process(packetSource, out, lim, stop), nil
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs nose-bleed and returns its exit status. Deferred cleanup, such as
+// flushing the outputs, runs before the process exits.
+func run() int {
+	// Run a command if one is given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "list-interfaces":
+			return listInterfaces(os.Args[2:])
+		case "consume":
+			return consume(os.Args[2:])
+		case "validate-config":
+			return validateConfig(os.Args[2:])
+		}
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s list-interfaces [-json]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s consume -config file [-key pattern] [-filter expr] [-output file] [-sink-config file] [-count n]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s validate-config -config file\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
 	// Set command line flags
-	device := flag.String("device", "eth0", "Device to sniff")
+	device := flag.String("device", "eth0", "Comma separated list of devices to sniff, or any for all devices")
 	snaplen := flag.Int("snaplen", 65535, "Snapshot length")
 	promiscuous := flag.Bool("promiscuous", false, "Set promiscuous mode")
 	timeout := flag.Duration("timeout", pcap.BlockForever, "Timeout")
 	filter := flag.String("filter", "", "Berkley Packet Filter (BPF)")
+	backend := flag.String("backend", backendPCAP, "Capture backend (pcap or afpacket)")
+	fanout := flag.String("fanout", "", "AF_PACKET fanout mode (hash, cpu or lb), empty to disable")
+	fanoutID := flag.Int("fanout-id", os.Getpid()&0xffff, "AF_PACKET fanout group id")
+	fanoutSockets := flag.Int("fanout-sockets", 1, "Number of AF_PACKET fanout sockets per device")
+	blockSize := flag.Int("afpacket-block-size", 1<<20, "AF_PACKET ring block size in bytes")
+	numBlocks := flag.Int("afpacket-blocks", 64, "Number of AF_PACKET ring blocks")
+	count := flag.Int("count", 0, "Stop after this many packets (0 for unlimited)")
+	duration := flag.Duration("duration", 0, "Stop after this duration, measured from the first packet when reading files (0 for unlimited)")
+	maxBytes := flag.Int64("max-bytes", 0, "Stop before capturing more than this many bytes (0 for unlimited)")
+	statsInterval := flag.Duration("stats-interval", time.Minute, "Interval between capture statistics records (0 to only send one at the end)")
 	showVersion := flag.Bool("version", false, "Show version")
 	logFilePath := flag.String("log", "./nose-bleed.log", "Path to log file")
 	configPath := flag.String("config", "", "Path to configuration file in JSON format")
+	readPaths := flag.String("read", "", "Comma separated list of pcap or pcapng files or glob patterns to read instead of sniffing")
+	writeDir := flag.String("write", "", "Directory to write captured packets to as pcap files")
+	writeFormat := flag.String("write-format", "pcap", "Format of the written capture files (pcap or pcapng)")
+	writeMaxSize := flag.Int64("write-max-size", 0, "Rotate pcap files after this many bytes (0 to disable)")
+	writeMaxAge := flag.Duration("write-rotate", 0, "Rotate pcap files after this duration, checked when a packet is written (0 to disable)")
+	writeMaxFiles := flag.Int("write-max-files", 0, "Maximum number of pcap files to retain (0 for unlimited)")
 
 	flag.Parse()
 
 	// Show version and exit if version flag is set
 	if *showVersion {
 		fmt.Println(version)
-		os.Exit(0)
+		return exitSuccess
 	}
 
 	// Configure logging
 	logFile, err := os.OpenFile(*logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to open log file:", err)
-		os.Exit(1)
+		return exitFailure
 	}
 	defer logFile.Close()
 	log.SetOutput(logFile)
@@ -241,17 +603,57 @@ func main() {
 	// Get settings
 	settings := new(Settings)
 	if *configPath != "" {
-		s, err := ioutil.ReadFile(*configPath)
-		if err != nil {
-			log.Fatalln("Failed to get settings:", err)
+		if settings, err = readSettings(*configPath); err != nil {
+			return fail("Failed to get settings:", err)
 		}
+	}
 
-		if err := json.Unmarshal(s, settings); err != nil {
-			log.Fatalln("Failed to unmarshal JSON settings:", err)
-		}
+	// Stop and flush the outputs on SIGINT or SIGTERM
+	stop := handleSignals()
+
+	limits := captureLimits{
+		Count:    *count,
+		Duration: *duration,
+		MaxBytes: *maxBytes,
 	}
 
-	// Start sniffing
-	sniff(*device, *snaplen, *promiscuous, *timeout, *filter, settings)
+	// Read capture files if given, otherwise start sniffing
+	if *readPaths != "" {
+		files, err := expandPaths(*readPaths)
+		if err != nil {
+			return fail("Failed to find capture files:", err)
+		}
+		if err := readFiles(files, *filter, limits, settings, stop); err != nil {
+			return fail("Failed to read capture files:", err)
+		}
+	} else {
+		writeOpts := pcapWriteOptions{
+			Dir:      *writeDir,
+			Format:   *writeFormat,
+			MaxSize:  *writeMaxSize,
+			MaxAge:   *writeMaxAge,
+			MaxFiles: *writeMaxFiles,
+		}
+		devices, err := captureDevices(*device)
+		if err != nil {
+			return fail("Failed to find capture devices:", err)
+		}
+		captureOpts := captureOptions{
+			SnapLen:       *snaplen,
+			Promiscuous:   *promiscuous,
+			Timeout:       *timeout,
+			Filter:        *filter,
+			Backend:       *backend,
+			Fanout:        *fanout,
+			FanoutID:      *fanoutID,
+			FanoutSockets: *fanoutSockets,
+			BlockSize:     *blockSize,
+			NumBlocks:     *numBlocks,
+		}
+		if err := sniff(devices, captureOpts, writeOpts, *statsInterval, limits, settings, stop); err != nil {
+			return fail("Failed to sniff:", err)
+		}
+	}
 
+	return exitSuccess
 }
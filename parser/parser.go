@@ -10,6 +10,16 @@ import (
 	"github.com/google/gopacket/layers"
 )
 
+// ParseError is returned by Parse when a protocol header cannot be parsed.
+type ParseError struct {
+	Protocol string
+	Err      error
+}
+
+func (e *ParseError) Error() string {
+	return e.Protocol + ": " + e.Err.Error()
+}
+
 // Parse parses a packet header.
 func Parse(packet gopacket.Packet) (map[string]interface{}, error) {
 	packetHeaders := make(map[string]interface{})
@@ -49,24 +59,33 @@ func Parse(packet gopacket.Packet) (map[string]interface{}, error) {
 		packetHeaders["ipv6"] = protocols.IPv6Parser(ip6Layer)
 	}
 
+	// gopacket stops at some IPv6 extension headers, such as segment
+	// routing headers, so decode the TCP or UDP segment after them here
+	transport := packet
+	if ip6Layer != nil && packet.TransportLayer() == nil {
+		if upper := protocols.IPv6UpperLayer(ip6Layer); upper != nil {
+			transport = upper
+		}
+	}
+
 	// If this is a UDP datagram, include it's header
-	udpLayer := packet.Layer(layers.LayerTypeUDP)
+	udpLayer := transport.Layer(layers.LayerTypeUDP)
 	if udpLayer != nil {
 		packetHeaders["udp"] = protocols.UDPParser(udpLayer)
 	}
 
 	// If this is a TCP segment, include it's header
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	tcpLayer := transport.Layer(layers.LayerTypeTCP)
 	if tcpLayer != nil {
 		packetHeaders["tcp"] = protocols.TCPParser(tcpLayer)
 	}
 
 	// If this packet has a DNS payload, include it's data
-	dnsLayer := packet.Layer(layers.LayerTypeDNS)
+	dnsLayer := transport.Layer(layers.LayerTypeDNS)
 	if dnsLayer != nil {
 		dns, err := protocols.DNSParser(dnsLayer)
 		if err != nil {
-			return nil, err
+			return nil, &ParseError{Protocol: "dns", Err: err}
 		}
 		packetHeaders["dns"] = dns
 	}
@@ -0,0 +1,130 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Names of ICMPv4 Destination Unreachable codes
+var icmpv4UnreachableCodes = map[uint8]string{
+	0:  "net_unreachable",
+	1:  "host_unreachable",
+	2:  "protocol_unreachable",
+	3:  "port_unreachable",
+	4:  "fragmentation_needed",
+	5:  "source_route_failed",
+	6:  "destination_network_unknown",
+	7:  "destination_host_unknown",
+	8:  "source_host_isolated",
+	9:  "network_administratively_prohibited",
+	10: "host_administratively_prohibited",
+	11: "network_unreachable_for_tos",
+	12: "host_unreachable_for_tos",
+	13: "communication_administratively_prohibited",
+	14: "host_precedence_violation",
+	15: "precedence_cutoff_in_effect",
+}
+
+// Names of ICMPv6 Destination Unreachable codes
+var icmpv6UnreachableCodes = map[uint8]string{
+	0: "no_route_to_destination",
+	1: "communication_administratively_prohibited",
+	2: "beyond_scope_of_source_address",
+	3: "address_unreachable",
+	4: "port_unreachable",
+	5: "source_address_failed_policy",
+	6: "reject_route_to_destination",
+	7: "error_in_source_routing_header",
+}
+
+// ICMPOriginal represents the start of the datagram quoted by an ICMP
+// error message. Only the fields that were quoted are set.
+type ICMPOriginal struct {
+	Version        int    `json:"version"`
+	Length         int    `json:"total_length"`
+	Identification *int   `json:"identification,omitempty"`
+	TTL            *int   `json:"ttl,omitempty"`
+	HopLimit       *int   `json:"hop_limit,omitempty"`
+	Protocol       string `json:"protocol"`
+	SourceAddress  string `json:"source_address"`
+	DestAddress    string `json:"destination_address"`
+	SourcePort     *int   `json:"source_port,omitempty"`
+	DestPort       *int   `json:"destination_port,omitempty"`
+	SequenceNumber *int   `json:"sequence_number,omitempty"`
+}
+
+// icmpOriginal parses the IP header and the start of the TCP or UDP header
+// quoted by an ICMPv4 or ICMPv6 error message. It returns nil if the IP
+// header is not complete.
+func icmpOriginal(data []byte) *ICMPOriginal {
+	if len(data) < 1 {
+		return nil
+	}
+
+	var original ICMPOriginal
+	var protocol layers.IPProtocol
+	var transport []byte
+
+	switch data[0] >> 4 {
+	case 4:
+		headerLength := int(data[0]&0x0f) * 4
+		if headerLength < 20 || headerLength > len(data) {
+			return nil
+		}
+		id := int(binary.BigEndian.Uint16(data[4:]))
+		ttl := int(data[8])
+		protocol = layers.IPProtocol(data[9])
+		original = ICMPOriginal{
+			Version:        4,
+			Length:         int(binary.BigEndian.Uint16(data[2:])),
+			Identification: &id,
+			TTL:            &ttl,
+			SourceAddress:  net.IP(data[12:16]).String(),
+			DestAddress:    net.IP(data[16:20]).String(),
+		}
+		// Only the first fragment holds the transport header
+		if binary.BigEndian.Uint16(data[6:])&0x1fff == 0 {
+			transport = data[headerLength:]
+		}
+	case 6:
+		if len(data) < 40 {
+			return nil
+		}
+		hopLimit := int(data[7])
+		original = ICMPOriginal{
+			Version:       6,
+			Length:        int(binary.BigEndian.Uint16(data[4:])),
+			HopLimit:      &hopLimit,
+			SourceAddress: net.IP(data[8:24]).String(),
+			DestAddress:   net.IP(data[24:40]).String(),
+		}
+
+		headers, next, _ := ipv6ExtensionHeaders(layers.IPProtocol(data[6]), data[40:])
+		protocol = next
+		transport = data[40:]
+		for _, header := range headers {
+			transport = transport[header.Length:]
+			if header.FragmentOffset != nil && *header.FragmentOffset != 0 {
+				transport = nil
+			}
+		}
+	default:
+		return nil
+	}
+	original.Protocol = protocol.String()
+
+	if (protocol == layers.IPProtocolTCP || protocol == layers.IPProtocolUDP) && len(transport) >= 4 {
+		sourcePort := int(binary.BigEndian.Uint16(transport))
+		destPort := int(binary.BigEndian.Uint16(transport[2:]))
+		original.SourcePort = &sourcePort
+		original.DestPort = &destPort
+	}
+	if protocol == layers.IPProtocolTCP && len(transport) >= 8 {
+		seq := int(binary.BigEndian.Uint32(transport[4:]))
+		original.SequenceNumber = &seq
+	}
+
+	return &original
+}
@@ -0,0 +1,145 @@
+package protocols
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// quotedIPv4 returns an IPv4 header with a protocol, fragment offset and
+// options, followed by the start of the datagram.
+func quotedIPv4(protocol byte, fragment uint16, options, data []byte) []byte {
+	ihl := (20 + len(options)) / 4
+	header := []byte{
+		byte(0x40 | ihl), 0, 0x05, 0xdc,
+		0x12, 0x34, byte(fragment >> 8), byte(fragment),
+		1, protocol, 0, 0,
+		192, 0, 2, 1,
+		198, 51, 100, 1,
+	}
+	header = append(header, options...)
+	return append(header, data...)
+}
+
+// quotedIPv6 returns an IPv6 header followed by extension headers and the
+// start of the datagram.
+func quotedIPv6(next byte, data []byte) []byte {
+	header := []byte{0x60, 0, 0, 0, 0x05, 0x00, next, 1}
+	header = append(header, net.ParseIP("2001:db8::1")...)
+	header = append(header, net.ParseIP("2001:db8::2")...)
+	return append(header, data...)
+}
+
+func TestICMPOriginal(t *testing.T) {
+	tcp := []byte{0x30, 0x39, 0x00, 0x50, 0, 0, 0, 7}
+	udp := []byte{0x30, 0x39, 0x00, 0x35, 0x00, 0x08, 0, 0}
+
+	ipv4 := func(protocol string, sourcePort, destPort, seq *int) *ICMPOriginal {
+		return &ICMPOriginal{Version: 4, Length: 1500, Identification: intPtr(0x1234), TTL: intPtr(1),
+			Protocol: protocol, SourceAddress: "192.0.2.1", DestAddress: "198.51.100.1",
+			SourcePort: sourcePort, DestPort: destPort, SequenceNumber: seq}
+	}
+	ipv6 := func(protocol string, sourcePort, destPort, seq *int) *ICMPOriginal {
+		return &ICMPOriginal{Version: 6, Length: 1280, HopLimit: intPtr(1),
+			Protocol: protocol, SourceAddress: "2001:db8::1", DestAddress: "2001:db8::2",
+			SourcePort: sourcePort, DestPort: destPort, SequenceNumber: seq}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want *ICMPOriginal
+	}{
+		{"empty", nil, nil},
+		{"not ip", []byte{0x50, 0, 0, 0}, nil},
+		{"ipv4 tcp", quotedIPv4(6, 0, nil, tcp), ipv4("TCP", intPtr(12345), intPtr(80), intPtr(7))},
+		{"ipv4 udp", quotedIPv4(17, 0x4000, nil, udp), ipv4("UDP", intPtr(12345), intPtr(53), nil)},
+		{"ipv4 icmp", quotedIPv4(1, 0, nil, []byte{8, 0, 0, 0, 0, 1, 0, 1}), ipv4("ICMPv4", nil, nil, nil)},
+		{"ipv4 options", quotedIPv4(17, 0, []byte{148, 4, 0, 0}, udp), ipv4("UDP", intPtr(12345), intPtr(53), nil)},
+		{"ipv4 tcp ports only", quotedIPv4(6, 0, nil, tcp[:4]), ipv4("TCP", intPtr(12345), intPtr(80), nil)},
+		{"ipv4 short transport", quotedIPv4(17, 0, nil, udp[:3]), ipv4("UDP", nil, nil, nil)},
+		{"ipv4 later fragment", quotedIPv4(17, 0x0010, nil, udp), ipv4("UDP", nil, nil, nil)},
+		{"ipv4 truncated header", quotedIPv4(17, 0, nil, nil)[:19], nil},
+		{"ipv4 truncated options", quotedIPv4(17, 0, []byte{148, 4, 0, 0}, nil)[:22], nil},
+		{"ipv4 header length too small", append([]byte{0x44}, quotedIPv4(17, 0, nil, udp)[1:]...), nil},
+		{"ipv6 tcp", quotedIPv6(6, tcp), ipv6("TCP", intPtr(12345), intPtr(80), intPtr(7))},
+		{"ipv6 udp", quotedIPv6(17, udp), ipv6("UDP", intPtr(12345), intPtr(53), nil)},
+		{"ipv6 extension headers", quotedIPv6(0, append([]byte{43, 0, 1, 4, 0, 0, 0, 0, 17, 0, 253, 0, 0, 0, 0, 0}, udp...)),
+			ipv6("UDP", intPtr(12345), intPtr(53), nil)},
+		{"ipv6 first fragment", quotedIPv6(44, append([]byte{6, 0, 0, 1, 0, 0, 0, 1}, tcp...)),
+			ipv6("TCP", intPtr(12345), intPtr(80), intPtr(7))},
+		{"ipv6 later fragment", quotedIPv6(44, append([]byte{17, 0, 0, 0x10, 0, 0, 0, 1}, udp...)),
+			ipv6("UDP", nil, nil, nil)},
+		{"ipv6 truncated extension header", quotedIPv6(0, []byte{17, 1, 1, 4, 0, 0, 0, 0}),
+			ipv6("IPv6HopByHop", nil, nil, nil)},
+		{"ipv6 truncated header", quotedIPv6(17, nil)[:39], nil},
+	}
+
+	for _, test := range tests {
+		got := icmpOriginal(test.data)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestICMPv4Parser(t *testing.T) {
+	udp := []byte{0x30, 0x39, 0x00, 0x35, 0x00, 0x08, 0, 0}
+
+	message := func(t, code uint8, id, seq uint16, body []byte) *layers.ICMPv4 {
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(t, code), Checksum: 0x1234, Id: id, Seq: seq}
+		icmp.Payload = body
+		return icmp
+	}
+	original := &ICMPOriginal{Version: 4, Length: 1500, Identification: intPtr(0x1234), TTL: intPtr(1),
+		Protocol: "UDP", SourceAddress: "192.0.2.1", DestAddress: "198.51.100.1",
+		SourcePort: intPtr(12345), DestPort: intPtr(53)}
+
+	tests := []struct {
+		name    string
+		message *layers.ICMPv4
+		want    ICMPv4Header
+	}{
+		{"echo request", message(8, 0, 1, 2, []byte("ping")),
+			ICMPv4Header{Type: 8, Checksum: 0x1234, Identification: 1, SequenceNumber: 2}},
+		{"port unreachable", message(3, 3, 0, 0, quotedIPv4(17, 0, nil, udp)),
+			ICMPv4Header{Type: 3, Code: 3, CodeName: "port_unreachable", Checksum: 0x1234, Original: original}},
+		{"fragmentation needed", message(3, 4, 0, 1400, quotedIPv4(17, 0, nil, udp)),
+			ICMPv4Header{Type: 3, Code: 4, CodeName: "fragmentation_needed", Checksum: 0x1234, SequenceNumber: 1400,
+				NextHopMTU: intPtr(1400), Original: original}},
+		{"unknown unreachable code", message(3, 99, 0, 0, nil),
+			ICMPv4Header{Type: 3, Code: 99, Checksum: 0x1234}},
+		{"time exceeded", message(11, 0, 0, 0, quotedIPv4(17, 0, nil, udp)),
+			ICMPv4Header{Type: 11, Checksum: 0x1234, Original: original}},
+		{"parameter problem", message(12, 0, 0x1400, 0, quotedIPv4(17, 0, nil, udp)),
+			ICMPv4Header{Type: 12, Checksum: 0x1234, Identification: 0x1400, Original: original}},
+		{"truncated quote", message(11, 0, 0, 0, quotedIPv4(17, 0, nil, nil)[:12]),
+			ICMPv4Header{Type: 11, Checksum: 0x1234}},
+	}
+
+	for _, test := range tests {
+		if got := ICMPv4Parser(test.message); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestICMPv6ErrorOriginal(t *testing.T) {
+	udp := []byte{0x30, 0x39, 0x00, 0x35, 0x00, 0x08, 0, 0}
+	quoted := quotedIPv6(17, udp)
+
+	for _, typ := range []uint8{1, 2, 3, 4} {
+		header := ICMPv6Parser(icmpv6Message(typ, 0, make([]byte, 4), quoted))
+		if header.Original == nil || header.Original.Protocol != "UDP" || header.Original.DestPort == nil ||
+			*header.Original.DestPort != 53 {
+			t.Errorf("type %d: got original %+v", typ, header.Original)
+		}
+	}
+
+	header := ICMPv6Parser(icmpv6Message(1, 0, make([]byte, 4), quoted[:30]))
+	if header.Original != nil {
+		t.Errorf("truncated quote: got original %+v", header.Original)
+	}
+}
@@ -7,11 +7,14 @@ import (
 
 // ICMPv4Header repesents and ICMPv4 header
 type ICMPv4Header struct {
-	Type           int `json:"type"`
-	Code           int `json:"code"`
-	Checksum       int `json:"checksum"`
-	Identification int `json:"identification"`
-	SequenceNumber int `json:"sequence_number"`
+	Type           int           `json:"type"`
+	Code           int           `json:"code"`
+	CodeName       string        `json:"code_name,omitempty"`
+	Checksum       int           `json:"checksum"`
+	Identification int           `json:"identification"`
+	SequenceNumber int           `json:"sequence_number"`
+	NextHopMTU     *int          `json:"next_hop_mtu,omitempty"`
+	Original       *ICMPOriginal `json:"original,omitempty"`
 }
 
 // ICMPv4Parser parses an ICMPv4 header
@@ -26,5 +29,18 @@ func ICMPv4Parser(layer gopacket.Layer) ICMPv4Header {
 		SequenceNumber: int(icmp.Seq),
 	}
 
+	// Error messages quote the start of the datagram that caused them
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv4TypeDestinationUnreachable:
+		icmpv4Header.CodeName = icmpv4UnreachableCodes[icmp.TypeCode.Code()]
+		if icmp.TypeCode.Code() == layers.ICMPv4CodeFragmentationNeeded {
+			mtu := int(icmp.Seq)
+			icmpv4Header.NextHopMTU = &mtu
+		}
+		icmpv4Header.Original = icmpOriginal(icmp.Payload)
+	case layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		icmpv4Header.Original = icmpOriginal(icmp.Payload)
+	}
+
 	return icmpv4Header
 }
@@ -1,16 +1,78 @@
 package protocols
 
 import (
+	"encoding/binary"
+	"net"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
-// ICMPv6Header represents and ICMPv6 header
+// ICMPv6 types decoded besides those of gopacket
+const (
+	icmpv6TypeMLDQuery    = 130
+	icmpv6TypeMLDReport   = 131
+	icmpv6TypeMLDDone     = 132
+	icmpv6TypeMLDv2Report = 143
+)
+
+// Names of MLDv2 multicast address record types
+var mldv2RecordTypes = map[uint8]string{
+	1: "MODE_IS_INCLUDE",
+	2: "MODE_IS_EXCLUDE",
+	3: "CHANGE_TO_INCLUDE_MODE",
+	4: "CHANGE_TO_EXCLUDE_MODE",
+	5: "ALLOW_NEW_SOURCES",
+	6: "BLOCK_OLD_SOURCES",
+}
+
+// Router preferences of Router Advertisements
+var routerPreferences = [4]string{"medium", "high", "reserved", "low"}
+
+// ICMPv6Header represents an ICMPv6 header. Only the fields of its type
+// are set.
 type ICMPv6Header struct {
 	Type     int `json:"type"`
 	Code     int `json:"code"`
 	Checksum int `json:"checksum"`
-	//TypeBytes
+	// Destination Unreachable
+	CodeName string `json:"code_name,omitempty"`
+	// Error messages
+	Original *ICMPOriginal `json:"original,omitempty"`
+	// Echo Request and Reply
+	Identification *int `json:"identification,omitempty"`
+	SequenceNumber *int `json:"sequence_number,omitempty"`
+	// Packet Too Big
+	MTU *int `json:"mtu,omitempty"`
+	// Parameter Problem
+	Pointer *int `json:"pointer,omitempty"`
+	// Router Advertisement
+	CurHopLimit      *int   `json:"cur_hop_limit,omitempty"`
+	RouterPreference string `json:"router_preference,omitempty"`
+	RouterLifetime   *int   `json:"router_lifetime,omitempty"`
+	ReachableTime    *int   `json:"reachable_time,omitempty"`
+	RetransTimer     *int   `json:"retrans_timer,omitempty"`
+	// Router Advertisement, Neighbor Advertisement and MLDv2 Query
+	Flags []string `json:"flags,omitempty"`
+	// Neighbor Solicitation and Advertisement and Redirect
+	TargetAddress string `json:"target_address,omitempty"`
+	DestAddress   string `json:"destination_address,omitempty"`
+	// MLD
+	MaxResponseDelay *int           `json:"max_response_delay,omitempty"`
+	MulticastAddress string         `json:"multicast_address,omitempty"`
+	QRV              *int           `json:"qrv,omitempty"`
+	QQIC             *int           `json:"qqic,omitempty"`
+	Sources          []string       `json:"sources,omitempty"`
+	Records          []MLDv2Record  `json:"records,omitempty"`
+	Options          []ICMPv6Option `json:"options,omitempty"`
+}
+
+// MLDv2Record represents a multicast address record of an MLDv2 report
+type MLDv2Record struct {
+	Type             int      `json:"type"`
+	Name             string   `json:"name"`
+	MulticastAddress string   `json:"multicast_address"`
+	Sources          []string `json:"sources"`
 }
 
 // ICMPv6Parser parses an ICMPv6 header
@@ -23,5 +85,161 @@ func ICMPv6Parser(layer gopacket.Layer) ICMPv6Header {
 		Checksum: int(icmpv6.Checksum),
 	}
 
+	typeBytes := icmpv6.TypeBytes
+	body := icmpv6.Payload
+	if len(typeBytes) < 4 {
+		return icmpv6Header
+	}
+
+	switch icmpv6.TypeCode.Type() {
+	case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+		id := int(binary.BigEndian.Uint16(typeBytes))
+		seq := int(binary.BigEndian.Uint16(typeBytes[2:]))
+		icmpv6Header.Identification = &id
+		icmpv6Header.SequenceNumber = &seq
+	case layers.ICMPv6TypeDestinationUnreachable:
+		icmpv6Header.CodeName = icmpv6UnreachableCodes[icmpv6.TypeCode.Code()]
+		icmpv6Header.Original = icmpOriginal(body)
+	case layers.ICMPv6TypePacketTooBig:
+		mtu := int(binary.BigEndian.Uint32(typeBytes))
+		icmpv6Header.MTU = &mtu
+		icmpv6Header.Original = icmpOriginal(body)
+	case layers.ICMPv6TypeTimeExceeded:
+		icmpv6Header.Original = icmpOriginal(body)
+	case layers.ICMPv6TypeParameterProblem:
+		pointer := int(binary.BigEndian.Uint32(typeBytes))
+		icmpv6Header.Pointer = &pointer
+		icmpv6Header.Original = icmpOriginal(body)
+	case layers.ICMPv6TypeRouterSolicitation:
+		icmpv6Header.Options = icmpv6Options(body)
+	case layers.ICMPv6TypeRouterAdvertisement:
+		routerAdvertisementParser(&icmpv6Header, typeBytes, body)
+	case layers.ICMPv6TypeNeighborSolicitation:
+		if len(body) >= 16 {
+			icmpv6Header.TargetAddress = net.IP(body[:16]).String()
+			icmpv6Header.Options = icmpv6Options(body[16:])
+		}
+	case layers.ICMPv6TypeNeighborAdvertisement:
+		icmpv6Header.Flags = make([]string, 0, 3)
+		if typeBytes[0]&0x80 != 0 {
+			icmpv6Header.Flags = append(icmpv6Header.Flags, "R")
+		}
+		if typeBytes[0]&0x40 != 0 {
+			icmpv6Header.Flags = append(icmpv6Header.Flags, "S")
+		}
+		if typeBytes[0]&0x20 != 0 {
+			icmpv6Header.Flags = append(icmpv6Header.Flags, "O")
+		}
+		if len(body) >= 16 {
+			icmpv6Header.TargetAddress = net.IP(body[:16]).String()
+			icmpv6Header.Options = icmpv6Options(body[16:])
+		}
+	case layers.ICMPv6TypeRedirect:
+		if len(body) >= 32 {
+			icmpv6Header.TargetAddress = net.IP(body[:16]).String()
+			icmpv6Header.DestAddress = net.IP(body[16:32]).String()
+			icmpv6Header.Options = icmpv6Options(body[32:])
+		}
+	case icmpv6TypeMLDQuery, icmpv6TypeMLDReport, icmpv6TypeMLDDone:
+		mldParser(&icmpv6Header, typeBytes, body)
+	case icmpv6TypeMLDv2Report:
+		mldv2ReportParser(&icmpv6Header, typeBytes, body)
+	}
+
 	return icmpv6Header
 }
+
+// routerAdvertisementParser parses the fields of a Router Advertisement.
+func routerAdvertisementParser(header *ICMPv6Header, typeBytes, body []byte) {
+	curHopLimit := int(typeBytes[0])
+	lifetime := int(binary.BigEndian.Uint16(typeBytes[2:]))
+	header.CurHopLimit = &curHopLimit
+	header.RouterLifetime = &lifetime
+
+	flags := typeBytes[1]
+	header.Flags = make([]string, 0, 4)
+	if flags&0x80 != 0 {
+		header.Flags = append(header.Flags, "M")
+	}
+	if flags&0x40 != 0 {
+		header.Flags = append(header.Flags, "O")
+	}
+	if flags&0x20 != 0 {
+		header.Flags = append(header.Flags, "H")
+	}
+	if flags&0x04 != 0 {
+		header.Flags = append(header.Flags, "P")
+	}
+	header.RouterPreference = routerPreferences[flags>>3&0x03]
+
+	if len(body) >= 8 {
+		reachable := int(binary.BigEndian.Uint32(body))
+		retrans := int(binary.BigEndian.Uint32(body[4:]))
+		header.ReachableTime = &reachable
+		header.RetransTimer = &retrans
+		header.Options = icmpv6Options(body[8:])
+	}
+}
+
+// mldParser parses the fields of an MLDv1 message or an MLDv2 query.
+func mldParser(header *ICMPv6Header, typeBytes, body []byte) {
+	if len(body) < 16 {
+		return
+	}
+	header.MulticastAddress = net.IP(body[:16]).String()
+
+	code := int(binary.BigEndian.Uint16(typeBytes))
+	// MLDv2 queries are longer and encode large delays with an exponent
+	if header.Type != icmpv6TypeMLDQuery || len(body) < 20 {
+		header.MaxResponseDelay = &code
+		return
+	}
+	if code >= 0x8000 {
+		code = (code&0x0fff | 0x1000) << (uint(code>>12&0x07) + 3)
+	}
+	header.MaxResponseDelay = &code
+
+	header.Flags = make([]string, 0, 1)
+	if body[16]&0x08 != 0 {
+		header.Flags = append(header.Flags, "S")
+	}
+	qrv := int(body[16] & 0x07)
+	qqic := int(body[17])
+	header.QRV = &qrv
+	header.QQIC = &qqic
+
+	sources := int(binary.BigEndian.Uint16(body[18:]))
+	header.Sources = ipv6Addresses(body[20:min(20+sources*16, len(body))])
+}
+
+// mldv2ReportParser parses the multicast address records of an MLDv2
+// report.
+func mldv2ReportParser(header *ICMPv6Header, typeBytes, body []byte) {
+	records := int(binary.BigEndian.Uint16(typeBytes[2:]))
+	header.Records = make([]MLDv2Record, 0, records)
+
+	for i := 0; i < records && len(body) >= 20; i++ {
+		auxLength := int(body[1]) * 4
+		sources := int(binary.BigEndian.Uint16(body[2:]))
+		end := 20 + sources*16
+		if end > len(body) {
+			break
+		}
+
+		header.Records = append(header.Records, MLDv2Record{
+			Type:             int(body[0]),
+			Name:             mldv2RecordTypes[body[0]],
+			MulticastAddress: net.IP(body[4:20]).String(),
+			Sources:          ipv6Addresses(body[20:end]),
+		})
+		body = body[min(end+auxLength, len(body)):]
+	}
+}
+
+// min returns the smaller of two ints.
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,112 @@
+package protocols
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// icmpv6Message returns an ICMPv6 layer with the four bytes that follow the
+// checksum and a body.
+func icmpv6Message(t, code uint8, typeBytes, body []byte) *layers.ICMPv6 {
+	icmpv6 := &layers.ICMPv6{
+		TypeCode:  layers.CreateICMPv6TypeCode(t, code),
+		Checksum:  0x1234,
+		TypeBytes: typeBytes,
+	}
+	icmpv6.Payload = body
+	return icmpv6
+}
+
+func TestICMPv6Parser(t *testing.T) {
+	target := net.ParseIP("fe80::1")
+	group := net.ParseIP("ff02::1:3")
+	source := net.ParseIP("2001:db8::1")
+	sll := []byte{1, 1, 0, 1, 2, 3, 4, 5}
+
+	mldv2Query := append(append([]byte{}, group...), 0x0a, 125, 0, 1)
+	mldv2Query = append(mldv2Query, source...)
+	record := append(append([]byte{4, 0, 0, 1}, group...), source...)
+	auxRecord := append(append([]byte{1, 1, 0, 0}, group...), 0xff, 0xff, 0xff, 0xff)
+
+	tests := []struct {
+		name    string
+		message *layers.ICMPv6
+		want    ICMPv6Header
+	}{
+		{"echo request", icmpv6Message(128, 0, []byte{0, 1, 0, 2}, nil),
+			ICMPv6Header{Type: 128, Checksum: 0x1234, Identification: intPtr(1), SequenceNumber: intPtr(2)}},
+		{"short type bytes", icmpv6Message(128, 0, []byte{0, 1}, nil),
+			ICMPv6Header{Type: 128, Checksum: 0x1234}},
+		{"packet too big", icmpv6Message(2, 0, []byte{0, 0, 0x05, 0x00}, nil),
+			ICMPv6Header{Type: 2, Checksum: 0x1234, MTU: intPtr(1280)}},
+		{"parameter problem", icmpv6Message(4, 0, []byte{0, 0, 0, 6}, nil),
+			ICMPv6Header{Type: 4, Checksum: 0x1234, Pointer: intPtr(6)}},
+		{"destination unreachable", icmpv6Message(1, 4, make([]byte, 4), nil),
+			ICMPv6Header{Type: 1, Code: 4, Checksum: 0x1234, CodeName: "port_unreachable"}},
+		{"router solicitation", icmpv6Message(133, 0, make([]byte, 4), sll),
+			ICMPv6Header{Type: 133, Checksum: 0x1234, Options: []ICMPv6Option{
+				{Type: 1, Name: "source_link_layer_address", Length: 8, LinkLayerAddress: "00:01:02:03:04:05"}}}},
+		{"router advertisement", icmpv6Message(134, 0, []byte{64, 0xcc, 0x07, 0x08}, append([]byte{0, 0, 0, 1, 0, 0, 0, 2}, sll...)),
+			ICMPv6Header{Type: 134, Checksum: 0x1234, CurHopLimit: intPtr(64), Flags: []string{"M", "O", "P"},
+				RouterPreference: "high", RouterLifetime: intPtr(1800), ReachableTime: intPtr(1), RetransTimer: intPtr(2),
+				Options: []ICMPv6Option{
+					{Type: 1, Name: "source_link_layer_address", Length: 8, LinkLayerAddress: "00:01:02:03:04:05"}}}},
+		{"truncated router advertisement", icmpv6Message(134, 0, []byte{64, 0x18, 0, 0}, []byte{0, 0, 0, 1}),
+			ICMPv6Header{Type: 134, Checksum: 0x1234, CurHopLimit: intPtr(64), Flags: []string{},
+				RouterPreference: "low", RouterLifetime: intPtr(0)}},
+		{"neighbor solicitation", icmpv6Message(135, 0, make([]byte, 4), append(append([]byte{}, target...), sll...)),
+			ICMPv6Header{Type: 135, Checksum: 0x1234, TargetAddress: "fe80::1", Options: []ICMPv6Option{
+				{Type: 1, Name: "source_link_layer_address", Length: 8, LinkLayerAddress: "00:01:02:03:04:05"}}}},
+		{"truncated neighbor solicitation", icmpv6Message(135, 0, make([]byte, 4), target[:8]),
+			ICMPv6Header{Type: 135, Checksum: 0x1234}},
+		{"neighbor advertisement", icmpv6Message(136, 0, []byte{0xe0, 0, 0, 0}, target),
+			ICMPv6Header{Type: 136, Checksum: 0x1234, Flags: []string{"R", "S", "O"}, TargetAddress: "fe80::1",
+				Options: []ICMPv6Option{}}},
+		{"truncated neighbor advertisement", icmpv6Message(136, 0, []byte{0x40, 0, 0, 0}, nil),
+			ICMPv6Header{Type: 136, Checksum: 0x1234, Flags: []string{"S"}}},
+		{"redirect", icmpv6Message(137, 0, make([]byte, 4), append(append([]byte{}, target...), source...)),
+			ICMPv6Header{Type: 137, Checksum: 0x1234, TargetAddress: "fe80::1", DestAddress: "2001:db8::1",
+				Options: []ICMPv6Option{}}},
+		{"truncated redirect", icmpv6Message(137, 0, make([]byte, 4), target),
+			ICMPv6Header{Type: 137, Checksum: 0x1234}},
+		{"mldv1 query", icmpv6Message(130, 0, []byte{0x27, 0x10, 0, 0}, group),
+			ICMPv6Header{Type: 130, Checksum: 0x1234, MaxResponseDelay: intPtr(10000), MulticastAddress: "ff02::1:3"}},
+		{"mldv1 report", icmpv6Message(131, 0, make([]byte, 4), group),
+			ICMPv6Header{Type: 131, Checksum: 0x1234, MaxResponseDelay: intPtr(0), MulticastAddress: "ff02::1:3"}},
+		{"mld done", icmpv6Message(132, 0, make([]byte, 4), group),
+			ICMPv6Header{Type: 132, Checksum: 0x1234, MaxResponseDelay: intPtr(0), MulticastAddress: "ff02::1:3"}},
+		{"truncated mld", icmpv6Message(131, 0, make([]byte, 4), group[:15]),
+			ICMPv6Header{Type: 131, Checksum: 0x1234}},
+		{"mldv2 query", icmpv6Message(130, 0, []byte{0x03, 0xe8, 0, 0}, mldv2Query),
+			ICMPv6Header{Type: 130, Checksum: 0x1234, MaxResponseDelay: intPtr(1000), MulticastAddress: "ff02::1:3",
+				Flags: []string{"S"}, QRV: intPtr(2), QQIC: intPtr(125), Sources: []string{"2001:db8::1"}}},
+		{"mldv2 query delay exponent", icmpv6Message(130, 0, []byte{0x80, 0x00, 0, 0}, mldv2Query[:20]),
+			ICMPv6Header{Type: 130, Checksum: 0x1234, MaxResponseDelay: intPtr(0x1000 << 3), MulticastAddress: "ff02::1:3",
+				Flags: []string{"S"}, QRV: intPtr(2), QQIC: intPtr(125), Sources: []string{}}},
+		{"mldv2 query sources beyond message", icmpv6Message(130, 0, []byte{0, 10, 0, 0}, mldv2Query[:30]),
+			ICMPv6Header{Type: 130, Checksum: 0x1234, MaxResponseDelay: intPtr(10), MulticastAddress: "ff02::1:3",
+				Flags: []string{"S"}, QRV: intPtr(2), QQIC: intPtr(125), Sources: []string{}}},
+		{"mldv2 report", icmpv6Message(143, 0, []byte{0, 0, 0, 2}, append(append([]byte{}, auxRecord...), record...)),
+			ICMPv6Header{Type: 143, Checksum: 0x1234, Records: []MLDv2Record{
+				{Type: 1, Name: "MODE_IS_INCLUDE", MulticastAddress: "ff02::1:3", Sources: []string{}},
+				{Type: 4, Name: "CHANGE_TO_EXCLUDE_MODE", MulticastAddress: "ff02::1:3", Sources: []string{"2001:db8::1"}},
+			}}},
+		{"mldv2 report with truncated record", icmpv6Message(143, 0, []byte{0, 0, 0, 2}, append(append([]byte{}, auxRecord...), record[:30]...)),
+			ICMPv6Header{Type: 143, Checksum: 0x1234, Records: []MLDv2Record{
+				{Type: 1, Name: "MODE_IS_INCLUDE", MulticastAddress: "ff02::1:3", Sources: []string{}},
+			}}},
+		{"mldv2 report with fewer records", icmpv6Message(143, 0, []byte{0, 0, 0, 3}, record),
+			ICMPv6Header{Type: 143, Checksum: 0x1234, Records: []MLDv2Record{
+				{Type: 4, Name: "CHANGE_TO_EXCLUDE_MODE", MulticastAddress: "ff02::1:3", Sources: []string{"2001:db8::1"}},
+			}}},
+	}
+
+	for _, test := range tests {
+		if got := ICMPv6Parser(test.message); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
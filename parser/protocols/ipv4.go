@@ -1,25 +1,182 @@
 package protocols
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// IPv4 option types, including the copied flag and class bits
+const (
+	ipv4OptionEOL         = 0
+	ipv4OptionNOP         = 1
+	ipv4OptionRecordRoute = 7
+	ipv4OptionTimestamp   = 68
+	ipv4OptionSecurity    = 130
+	ipv4OptionLSRR        = 131
+	ipv4OptionSSRR        = 137
+	ipv4OptionRouterAlert = 148
+)
+
+// IPv4 Timestamp option flags
+const (
+	ipv4TimestampOnly      = 0
+	ipv4TimestampAddresses = 1
+	ipv4TimestampPrespec   = 3
+)
+
+// Classification levels of the security option (RFC 1108)
+var ipv4SecurityLevels = map[byte]string{
+	0x01: "Reserved 4",
+	0x3d: "Top Secret",
+	0x5a: "Secret",
+	0x96: "Confidential",
+	0x66: "Reserved 3",
+	0xcc: "Reserved 2",
+	0xab: "Unclassified",
+	0xf1: "Reserved 1",
+}
+
 // IPv4Header repesents an IPv4 packet header
 type IPv4Header struct {
-	Version        int      `json:"version"`
-	IHL            int      `json:"header_length"`
-	TOS            int      `json:"tos"`
-	Length         int      `json:"total_length"`
-	Identification int      `json:"identification"`
-	Flags          []string `json:"flags"`
-	FragOffset     int      `json:"fragment_offset"`
-	TTL            int      `json:"ttl"`
-	Protocol       string   `json:"protocol"`
-	Checksum       int      `json:"checksum"`
-	SourceAddress  string   `json:"source_address"`
-	DestAddress    string   `json:"destination_address"`
-	//Options
+	Version        int          `json:"version"`
+	IHL            int          `json:"header_length"`
+	TOS            int          `json:"tos"`
+	Length         int          `json:"total_length"`
+	Identification int          `json:"identification"`
+	Flags          []string     `json:"flags"`
+	FragOffset     int          `json:"fragment_offset"`
+	TTL            int          `json:"ttl"`
+	Protocol       string       `json:"protocol"`
+	Checksum       int          `json:"checksum"`
+	SourceAddress  string       `json:"source_address"`
+	DestAddress    string       `json:"destination_address"`
+	Options        []IPv4Option `json:"options"`
+}
+
+// IPv4Option represents an IPv4 option. Record Route and Timestamp options
+// hold the entries recorded so far, before the pointer, and source route
+// options the whole route. Unknown and malformed options hold their data as
+// hex.
+type IPv4Option struct {
+	Type                int             `json:"type"`
+	Name                string          `json:"name"`
+	Length              int             `json:"length"`
+	Pointer             *int            `json:"pointer,omitempty"`
+	Route               []string        `json:"route,omitempty"`
+	Overflow            *int            `json:"overflow,omitempty"`
+	TimestampFlag       *int            `json:"timestamp_flag,omitempty"`
+	Timestamps          []IPv4Timestamp `json:"timestamps,omitempty"`
+	RouterAlert         *int            `json:"router_alert,omitempty"`
+	Classification      string          `json:"classification,omitempty"`
+	ProtectionAuthority string          `json:"protection_authority,omitempty"`
+	Data                string          `json:"data,omitempty"`
+}
+
+// IPv4Timestamp represents an entry of an IPv4 Timestamp option
+type IPv4Timestamp struct {
+	Address   string `json:"address,omitempty"`
+	Timestamp int    `json:"timestamp"`
+}
+
+// ipv4OptionParser parses an IPv4 option
+func ipv4OptionParser(option layers.IPv4Option) IPv4Option {
+	opt := IPv4Option{
+		Type:   int(option.OptionType),
+		Length: int(option.OptionLength),
+	}
+	data := option.OptionData
+
+	switch {
+	case option.OptionType == ipv4OptionEOL:
+		opt.Name = "eol"
+	case option.OptionType == ipv4OptionNOP:
+		opt.Name = "nop"
+	case option.OptionType == ipv4OptionRecordRoute && len(data) >= 1 && (len(data)-1)%4 == 0:
+		opt.Name = "record_route"
+		pointer := int(data[0])
+		opt.Pointer = &pointer
+		// The pointer counts from the option type and starts at 4
+		recorded := clamp(pointer-4, 0, len(data)-1)
+		opt.Route = ipv4Addresses(data[1 : 1+recorded-recorded%4])
+	case (option.OptionType == ipv4OptionLSRR || option.OptionType == ipv4OptionSSRR) &&
+		len(data) >= 1 && (len(data)-1)%4 == 0:
+		opt.Name = "lsrr"
+		if option.OptionType == ipv4OptionSSRR {
+			opt.Name = "ssrr"
+		}
+		pointer := int(data[0])
+		opt.Pointer = &pointer
+		opt.Route = ipv4Addresses(data[1:])
+	case option.OptionType == ipv4OptionTimestamp && len(data) >= 2:
+		flag := int(data[1] & 0x0f)
+		entrySize := 4
+		if flag == ipv4TimestampAddresses || flag == ipv4TimestampPrespec {
+			entrySize = 8
+		} else if flag != ipv4TimestampOnly {
+			opt.Name = "unknown"
+			opt.Data = hex.EncodeToString(data)
+			break
+		}
+
+		opt.Name = "timestamp"
+		pointer := int(data[0])
+		overflow := int(data[1] >> 4)
+		opt.Pointer = &pointer
+		opt.Overflow = &overflow
+		opt.TimestampFlag = &flag
+
+		// The pointer counts from the option type and starts at 5
+		entries := data[2:]
+		recorded := clamp(pointer-5, 0, len(entries))
+		for i := 0; i+entrySize <= recorded; i += entrySize {
+			var ts IPv4Timestamp
+			if entrySize == 8 {
+				ts.Address = net.IP(entries[i : i+4]).String()
+			}
+			ts.Timestamp = int(binary.BigEndian.Uint32(entries[i+entrySize-4:]))
+			opt.Timestamps = append(opt.Timestamps, ts)
+		}
+	case option.OptionType == ipv4OptionRouterAlert && len(data) == 2:
+		opt.Name = "router_alert"
+		value := int(binary.BigEndian.Uint16(data))
+		opt.RouterAlert = &value
+	case option.OptionType == ipv4OptionSecurity && len(data) >= 1:
+		opt.Name = "security"
+		opt.Classification = ipv4SecurityLevels[data[0]]
+		if opt.Classification == "" {
+			opt.Classification = hex.EncodeToString(data[:1])
+		}
+		opt.ProtectionAuthority = hex.EncodeToString(data[1:])
+	default:
+		opt.Name = "unknown"
+		opt.Data = hex.EncodeToString(data)
+	}
+
+	return opt
+}
+
+// ipv4Addresses returns the IPv4 addresses of an option.
+func ipv4Addresses(data []byte) []string {
+	addresses := make([]string, 0, len(data)/4)
+	for i := 0; i+4 <= len(data); i += 4 {
+		addresses = append(addresses, net.IP(data[i:i+4]).String())
+	}
+	return addresses
+}
+
+// clamp returns n limited to the range from min to max.
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
 }
 
 // IPv4Parser parses an IPv4 packet header
@@ -28,16 +185,25 @@ func IPv4Parser(layer gopacket.Layer) IPv4Header {
 
 	ip := layer.(*layers.IPv4)
 
-	if ip.Flags == layers.IPv4EvilBit {
+	if ip.Flags&layers.IPv4EvilBit != 0 {
 		ipv4Flags = append(ipv4Flags, "EB")
 	}
-	if ip.Flags == layers.IPv4DontFragment {
+	if ip.Flags&layers.IPv4DontFragment != 0 {
 		ipv4Flags = append(ipv4Flags, "DF")
 	}
-	if ip.Flags == layers.IPv4MoreFragments {
+	if ip.Flags&layers.IPv4MoreFragments != 0 {
 		ipv4Flags = append(ipv4Flags, "MF")
 	}
 
+	ipv4Options := make([]IPv4Option, 0, len(ip.Options))
+	for _, option := range ip.Options {
+		ipv4Options = append(ipv4Options, ipv4OptionParser(option))
+		// What follows the end of the option list is padding
+		if option.OptionType == ipv4OptionEOL {
+			break
+		}
+	}
+
 	ipv4Header := IPv4Header{
 		Version:        int(ip.Version),
 		IHL:            int(ip.IHL),
@@ -51,6 +217,7 @@ func IPv4Parser(layer gopacket.Layer) IPv4Header {
 		Checksum:       int(ip.Checksum),
 		SourceAddress:  ip.SrcIP.String(),
 		DestAddress:    ip.DstIP.String(),
+		Options:        ipv4Options,
 	}
 
 	return ipv4Header
@@ -0,0 +1,161 @@
+package protocols
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestIPv4OptionParser(t *testing.T) {
+	route := []byte{10, 0, 0, 1, 10, 0, 0, 2, 10, 0, 0, 3}
+
+	tests := []struct {
+		name   string
+		option layers.IPv4Option
+		want   IPv4Option
+	}{
+		{"eol", layers.IPv4Option{OptionType: 0, OptionLength: 1},
+			IPv4Option{Type: 0, Name: "eol", Length: 1}},
+		{"nop", layers.IPv4Option{OptionType: 1, OptionLength: 1},
+			IPv4Option{Type: 1, Name: "nop", Length: 1}},
+		{"record route", layers.IPv4Option{OptionType: 7, OptionLength: 15, OptionData: append([]byte{12}, route...)},
+			IPv4Option{Type: 7, Name: "record_route", Length: 15, Pointer: intPtr(12),
+				Route: []string{"10.0.0.1", "10.0.0.2"}}},
+		{"empty record route", layers.IPv4Option{OptionType: 7, OptionLength: 15, OptionData: append([]byte{4}, route...)},
+			IPv4Option{Type: 7, Name: "record_route", Length: 15, Pointer: intPtr(4), Route: []string{}}},
+		{"full record route", layers.IPv4Option{OptionType: 7, OptionLength: 15, OptionData: append([]byte{16}, route...)},
+			IPv4Option{Type: 7, Name: "record_route", Length: 15, Pointer: intPtr(16),
+				Route: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}},
+		{"record route pointer beyond option", layers.IPv4Option{OptionType: 7, OptionLength: 15, OptionData: append([]byte{200}, route...)},
+			IPv4Option{Type: 7, Name: "record_route", Length: 15, Pointer: intPtr(200),
+				Route: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}},
+		{"record route pointer before entries", layers.IPv4Option{OptionType: 7, OptionLength: 15, OptionData: append([]byte{1}, route...)},
+			IPv4Option{Type: 7, Name: "record_route", Length: 15, Pointer: intPtr(1), Route: []string{}}},
+		{"truncated record route", layers.IPv4Option{OptionType: 7, OptionLength: 6, OptionData: []byte{4, 10, 0, 0}},
+			IPv4Option{Type: 7, Name: "unknown", Length: 6, Data: "040a0000"}},
+		{"empty record route option", layers.IPv4Option{OptionType: 7, OptionLength: 2},
+			IPv4Option{Type: 7, Name: "unknown", Length: 2}},
+		{"lsrr", layers.IPv4Option{OptionType: 131, OptionLength: 11, OptionData: append([]byte{4}, route[:8]...)},
+			IPv4Option{Type: 131, Name: "lsrr", Length: 11, Pointer: intPtr(4), Route: []string{"10.0.0.1", "10.0.0.2"}}},
+		{"ssrr", layers.IPv4Option{OptionType: 137, OptionLength: 7, OptionData: append([]byte{8}, route[:4]...)},
+			IPv4Option{Type: 137, Name: "ssrr", Length: 7, Pointer: intPtr(8), Route: []string{"10.0.0.1"}}},
+		{"truncated ssrr", layers.IPv4Option{OptionType: 137, OptionLength: 5, OptionData: []byte{4, 10, 0}},
+			IPv4Option{Type: 137, Name: "unknown", Length: 5, Data: "040a00"}},
+		{"timestamps only", layers.IPv4Option{OptionType: 68, OptionLength: 12,
+			OptionData: []byte{9, 0x10, 0, 0, 0, 1, 0, 0, 0, 2}},
+			IPv4Option{Type: 68, Name: "timestamp", Length: 12, Pointer: intPtr(9), Overflow: intPtr(1),
+				TimestampFlag: intPtr(0), Timestamps: []IPv4Timestamp{{Timestamp: 1}}}},
+		{"timestamps with addresses", layers.IPv4Option{OptionType: 68, OptionLength: 20,
+			OptionData: []byte{21, 0x01, 10, 0, 0, 1, 0, 0, 0, 1, 10, 0, 0, 2, 0, 0, 0, 2}},
+			IPv4Option{Type: 68, Name: "timestamp", Length: 20, Pointer: intPtr(21), Overflow: intPtr(0),
+				TimestampFlag: intPtr(1), Timestamps: []IPv4Timestamp{{"10.0.0.1", 1}, {"10.0.0.2", 2}}}},
+		{"prespecified timestamps", layers.IPv4Option{OptionType: 68, OptionLength: 12,
+			OptionData: []byte{5, 0x03, 10, 0, 0, 1, 0, 0, 0, 0}},
+			IPv4Option{Type: 68, Name: "timestamp", Length: 12, Pointer: intPtr(5), Overflow: intPtr(0),
+				TimestampFlag: intPtr(3)}},
+		{"timestamp pointer beyond option", layers.IPv4Option{OptionType: 68, OptionLength: 10,
+			OptionData: []byte{255, 0x01, 10, 0, 0, 1, 0, 0}},
+			IPv4Option{Type: 68, Name: "timestamp", Length: 10, Pointer: intPtr(255), Overflow: intPtr(0),
+				TimestampFlag: intPtr(1)}},
+		{"timestamp flag", layers.IPv4Option{OptionType: 68, OptionLength: 8, OptionData: []byte{5, 0x02, 0, 0, 0, 1}},
+			IPv4Option{Type: 68, Name: "unknown", Length: 8, Data: "050200000001"}},
+		{"short timestamp", layers.IPv4Option{OptionType: 68, OptionLength: 3, OptionData: []byte{5}},
+			IPv4Option{Type: 68, Name: "unknown", Length: 3, Data: "05"}},
+		{"router alert", layers.IPv4Option{OptionType: 148, OptionLength: 4, OptionData: []byte{0, 0}},
+			IPv4Option{Type: 148, Name: "router_alert", Length: 4, RouterAlert: intPtr(0)}},
+		{"long router alert", layers.IPv4Option{OptionType: 148, OptionLength: 5, OptionData: []byte{0, 0, 1}},
+			IPv4Option{Type: 148, Name: "unknown", Length: 5, Data: "000001"}},
+		{"security", layers.IPv4Option{OptionType: 130, OptionLength: 4, OptionData: []byte{0xab, 0x80}},
+			IPv4Option{Type: 130, Name: "security", Length: 4, Classification: "Unclassified", ProtectionAuthority: "80"}},
+		{"unknown security level", layers.IPv4Option{OptionType: 130, OptionLength: 3, OptionData: []byte{0x42}},
+			IPv4Option{Type: 130, Name: "security", Length: 3, Classification: "42"}},
+		{"empty security", layers.IPv4Option{OptionType: 130, OptionLength: 2},
+			IPv4Option{Type: 130, Name: "unknown", Length: 2}},
+		{"unknown", layers.IPv4Option{OptionType: 25, OptionLength: 4, OptionData: []byte{1, 2}},
+			IPv4Option{Type: 25, Name: "unknown", Length: 4, Data: "0102"}},
+	}
+
+	for _, test := range tests {
+		if got := ipv4OptionParser(test.option); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// ipv4Packet returns an IPv4 header with options and flags, without payload.
+func ipv4Packet(flags byte, options []byte) []byte {
+	ihl := (20 + len(options)) / 4
+	length := ihl * 4
+	packet := []byte{
+		byte(0x40 | ihl), 0x00, byte(length >> 8), byte(length),
+		0x12, 0x34, flags, 0x00, // identification, flags and fragment offset
+		64, 17, 0x00, 0x00, // ttl, UDP and checksum
+		192, 0, 2, 1,
+		198, 51, 100, 1,
+	}
+	return append(packet, options...)
+}
+
+func TestIPv4Parser(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		flags   []string
+		options []IPv4Option
+	}{
+		{"no options", ipv4Packet(0x40, nil), []string{"DF"}, []IPv4Option{}},
+		{"combined flags", ipv4Packet(0xe0, nil), []string{"EB", "DF", "MF"}, []IPv4Option{}},
+		{"padding after eol", ipv4Packet(0x20, []byte{148, 4, 0, 0, 1, 0, 0, 0}), []string{"MF"}, []IPv4Option{
+			{Type: 148, Name: "router_alert", Length: 4, RouterAlert: intPtr(0)},
+			{Type: 1, Name: "nop", Length: 1},
+			{Type: 0, Name: "eol", Length: 1},
+		}},
+	}
+
+	for _, test := range tests {
+		packet := gopacket.NewPacket(test.packet, layers.LayerTypeIPv4, gopacket.Default)
+		layer := packet.Layer(layers.LayerTypeIPv4)
+		if layer == nil {
+			t.Errorf("%s: not decoded: %v", test.name, packet.ErrorLayer().Error())
+			continue
+		}
+
+		header := IPv4Parser(layer)
+		if header.Version != 4 || header.IHL != len(test.packet)/4 || header.Identification != 0x1234 ||
+			header.TTL != 64 || header.Protocol != "UDP" || header.SourceAddress != "192.0.2.1" ||
+			header.DestAddress != "198.51.100.1" {
+			t.Errorf("%s: got header %+v", test.name, header)
+		}
+		if !reflect.DeepEqual(header.Flags, test.flags) {
+			t.Errorf("%s: got flags %v, want %v", test.name, header.Flags, test.flags)
+		}
+		if !reflect.DeepEqual(header.Options, test.options) {
+			t.Errorf("%s: got options %+v, want %+v", test.name, header.Options, test.options)
+		}
+	}
+}
+
+func TestIPv4Truncated(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"short header", ipv4Packet(0x00, nil)[:16]},
+		{"option beyond header", ipv4Packet(0x00, []byte{7, 11, 4, 0})},
+		{"header length beyond packet", append([]byte{0x4f}, ipv4Packet(0x00, nil)[1:]...)},
+	}
+
+	for _, test := range tests {
+		packet := gopacket.NewPacket(test.packet, layers.LayerTypeIPv4, gopacket.Default)
+		if layer := packet.Layer(layers.LayerTypeIPv4); layer != nil {
+			// Whatever gopacket decodes must not make the parser panic
+			IPv4Parser(layer)
+			continue
+		}
+		if packet.ErrorLayer() == nil {
+			t.Errorf("%s: expected a decoding error", test.name)
+		}
+	}
+}
@@ -1,37 +1,290 @@
 package protocols
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// IPv6 Hop-by-Hop and Destination option types
+const (
+	ipv6OptionPad1        = 0x00
+	ipv6OptionPadN        = 0x01
+	ipv6OptionTunnelLimit = 0x04
+	ipv6OptionRouterAlert = 0x05
+	ipv6OptionJumbo       = 0xc2
+	ipv6OptionHomeAddress = 0xc9
+)
+
+// IPv6 routing header types
+const (
+	ipv6RoutingType0       = 0
+	ipv6RoutingMobileIPv6  = 2
+	ipv6RoutingSegmentList = 4
+)
+
 // IPv6Header represents an IPv6 packet header
 type IPv6Header struct {
-	Version       int    `json:"version"`
-	TrafficClass  int    `json:"traffic_class"`
-	FlowLabel     int    `json:"flow_label"`
-	Length        int    `json:"total_length"`
-	NextHeader    string `json:"next_header"`
-	HopLimit      int    `json:"hop_limit"`
-	SourceAddress string `json:"source_address"`
-	DestAddress   string `json:"destination_address"`
-	//HopByHop
+	Version          int                   `json:"version"`
+	TrafficClass     int                   `json:"traffic_class"`
+	FlowLabel        int                   `json:"flow_label"`
+	Length           int                   `json:"total_length"`
+	NextHeader       string                `json:"next_header"`
+	HopLimit         int                   `json:"hop_limit"`
+	SourceAddress    string                `json:"source_address"`
+	DestAddress      string                `json:"destination_address"`
+	ExtensionHeaders []IPv6ExtensionHeader `json:"extension_headers"`
+	UpperLayer       string                `json:"upper_layer_protocol"`
+}
+
+// IPv6ExtensionHeader represents an IPv6 extension header. Only the fields
+// of its type are set.
+type IPv6ExtensionHeader struct {
+	Type       string `json:"type"`
+	NextHeader string `json:"next_header"`
+	Length     int    `json:"length"`
+	// Hop-by-Hop and Destination Options
+	Options []IPv6Option `json:"options,omitempty"`
+	// Routing
+	RoutingType  *int     `json:"routing_type,omitempty"`
+	SegmentsLeft *int     `json:"segments_left,omitempty"`
+	LastEntry    *int     `json:"last_entry,omitempty"`
+	Flags        *int     `json:"flags,omitempty"`
+	Tag          *int     `json:"tag,omitempty"`
+	Addresses    []string `json:"addresses,omitempty"`
+	// Fragment
+	FragmentOffset *int  `json:"fragment_offset,omitempty"`
+	MoreFragments  *bool `json:"more_fragments,omitempty"`
+	Identification *int  `json:"identification,omitempty"`
+	// Authentication Header
+	SPI            *int `json:"spi,omitempty"`
+	SequenceNumber *int `json:"sequence_number,omitempty"`
+	// Data of undecoded routing types and of SRH TLVs, as hex
+	Data string `json:"data,omitempty"`
+}
+
+// IPv6Option represents a TLV option of a Hop-by-Hop or Destination
+// Options header. Unknown options hold their data as hex.
+type IPv6Option struct {
+	Type               int    `json:"type"`
+	Name               string `json:"name"`
+	Length             int    `json:"length"`
+	RouterAlert        *int   `json:"router_alert,omitempty"`
+	JumboPayloadLength *int   `json:"jumbo_payload_length,omitempty"`
+	TunnelLimit        *int   `json:"tunnel_encapsulation_limit,omitempty"`
+	HomeAddress        string `json:"home_address,omitempty"`
+	Data               string `json:"data,omitempty"`
 }
 
 // IPv6Parser parses an IPv6 packet header
 func IPv6Parser(layer gopacket.Layer) IPv6Header {
 	ipv6 := layer.(*layers.IPv6)
 
+	extensionHeaders, upperLayer, _ := ipv6ExtensionHeaders(ipv6.NextHeader, ipv6.Payload)
+
 	ipv6Header := IPv6Header{
-		Version:       int(ipv6.Version),
-		TrafficClass:  int(ipv6.TrafficClass),
-		FlowLabel:     int(ipv6.FlowLabel),
-		Length:        int(ipv6.Length),
-		NextHeader:    ipv6.NextHeader.String(),
-		HopLimit:      int(ipv6.HopLimit),
-		SourceAddress: ipv6.SrcIP.String(),
-		DestAddress:   ipv6.DstIP.String(),
+		Version:          int(ipv6.Version),
+		TrafficClass:     int(ipv6.TrafficClass),
+		FlowLabel:        int(ipv6.FlowLabel),
+		Length:           int(ipv6.Length),
+		NextHeader:       ipv6.NextHeader.String(),
+		HopLimit:         int(ipv6.HopLimit),
+		SourceAddress:    ipv6.SrcIP.String(),
+		DestAddress:      ipv6.DstIP.String(),
+		ExtensionHeaders: extensionHeaders,
+		UpperLayer:       upperLayer.String(),
 	}
 
 	return ipv6Header
 }
+
+// ipv6ExtensionHeaders walks the extension header chain at the start of
+// the payload of an IPv6 packet. It returns the headers in order, the
+// protocol that follows them and its data. The walk stops at a truncated
+// header or at a fragment other than the first, which has no data.
+func ipv6ExtensionHeaders(next layers.IPProtocol, data []byte) ([]IPv6ExtensionHeader, layers.IPProtocol, []byte) {
+	headers := make([]IPv6ExtensionHeader, 0)
+
+	for len(data) >= 8 {
+		var length int
+		switch next {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			length = (int(data[1]) + 1) * 8
+		case layers.IPProtocolIPv6Fragment:
+			length = 8
+		case layers.IPProtocolAH:
+			length = (int(data[1]) + 2) * 4
+		default:
+			return headers, next, data
+		}
+		if length > len(data) {
+			return headers, next, data
+		}
+
+		header := IPv6ExtensionHeader{
+			NextHeader: layers.IPProtocol(data[0]).String(),
+			Length:     length,
+		}
+		body := data[2:length]
+
+		switch next {
+		case layers.IPProtocolIPv6HopByHop:
+			header.Type = "hop_by_hop"
+			header.Options = ipv6Options(body)
+		case layers.IPProtocolIPv6Destination:
+			header.Type = "destination_options"
+			header.Options = ipv6Options(body)
+		case layers.IPProtocolIPv6Routing:
+			header.Type = "routing"
+			ipv6RoutingParser(&header, body)
+		case layers.IPProtocolIPv6Fragment:
+			header.Type = "fragment"
+			offset := int(binary.BigEndian.Uint16(body) >> 3)
+			more := body[1]&0x01 != 0
+			id := int(binary.BigEndian.Uint32(body[2:]))
+			header.FragmentOffset = &offset
+			header.MoreFragments = &more
+			header.Identification = &id
+		case layers.IPProtocolAH:
+			header.Type = "authentication"
+			if len(body) >= 10 {
+				spi := int(binary.BigEndian.Uint32(body[2:]))
+				seq := int(binary.BigEndian.Uint32(body[6:]))
+				header.SPI = &spi
+				header.SequenceNumber = &seq
+			}
+		}
+
+		headers = append(headers, header)
+		next = layers.IPProtocol(data[0])
+		data = data[length:]
+
+		// Only the first fragment holds the following headers
+		if header.FragmentOffset != nil && *header.FragmentOffset != 0 {
+			return headers, next, nil
+		}
+	}
+
+	return headers, next, data
+}
+
+// IPv6UpperLayer decodes the TCP or UDP segment that follows the extension
+// headers of an IPv6 packet, with its payload, for the packets gopacket
+// leaves undecoded, such as those with a segment routing header. It
+// returns nil for other protocols.
+func IPv6UpperLayer(layer gopacket.Layer) gopacket.Packet {
+	ipv6 := layer.(*layers.IPv6)
+
+	_, next, data := ipv6ExtensionHeaders(ipv6.NextHeader, ipv6.Payload)
+
+	var first gopacket.LayerType
+	switch next {
+	case layers.IPProtocolTCP:
+		first = layers.LayerTypeTCP
+	case layers.IPProtocolUDP:
+		first = layers.LayerTypeUDP
+	default:
+		return nil
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	return gopacket.NewPacket(data, first, gopacket.Default)
+}
+
+// ipv6RoutingParser parses the body of a routing header, after the next
+// header and length fields.
+func ipv6RoutingParser(header *IPv6ExtensionHeader, body []byte) {
+	routingType := int(body[0])
+	segmentsLeft := int(body[1])
+	header.RoutingType = &routingType
+	header.SegmentsLeft = &segmentsLeft
+
+	switch routingType {
+	case ipv6RoutingType0, ipv6RoutingMobileIPv6:
+		header.Addresses = ipv6Addresses(body[6:])
+	case ipv6RoutingSegmentList:
+		lastEntry := int(body[2])
+		flags := int(body[3])
+		tag := int(binary.BigEndian.Uint16(body[4:]))
+		header.LastEntry = &lastEntry
+		header.Flags = &flags
+		header.Tag = &tag
+
+		segments := body[6:]
+		if end := (lastEntry + 1) * 16; end <= len(segments) {
+			header.Addresses = ipv6Addresses(segments[:end])
+			if tlvs := segments[end:]; len(tlvs) > 0 {
+				header.Data = hex.EncodeToString(tlvs)
+			}
+		} else {
+			header.Data = hex.EncodeToString(segments)
+		}
+	default:
+		header.Data = hex.EncodeToString(body[2:])
+	}
+}
+
+// ipv6Options parses the TLV options of a Hop-by-Hop or Destination
+// Options header, leaving out the padding.
+func ipv6Options(data []byte) []IPv6Option {
+	options := make([]IPv6Option, 0)
+
+	for len(data) > 0 {
+		if data[0] == ipv6OptionPad1 {
+			data = data[1:]
+			continue
+		}
+		if len(data) < 2 || int(data[1])+2 > len(data) {
+			options = append(options, IPv6Option{Type: int(data[0]), Name: "malformed", Data: hex.EncodeToString(data)})
+			break
+		}
+
+		value := data[2 : 2+int(data[1])]
+		opt := IPv6Option{
+			Type:   int(data[0]),
+			Length: len(value),
+		}
+		data = data[2+len(value):]
+
+		switch {
+		case opt.Type == ipv6OptionPadN:
+			continue
+		case opt.Type == ipv6OptionRouterAlert && len(value) == 2:
+			opt.Name = "router_alert"
+			alert := int(binary.BigEndian.Uint16(value))
+			opt.RouterAlert = &alert
+		case opt.Type == ipv6OptionJumbo && len(value) == 4:
+			opt.Name = "jumbo_payload"
+			jumbo := int(binary.BigEndian.Uint32(value))
+			opt.JumboPayloadLength = &jumbo
+		case opt.Type == ipv6OptionTunnelLimit && len(value) == 1:
+			opt.Name = "tunnel_encapsulation_limit"
+			limit := int(value[0])
+			opt.TunnelLimit = &limit
+		case opt.Type == ipv6OptionHomeAddress && len(value) == 16:
+			opt.Name = "home_address"
+			opt.HomeAddress = net.IP(value).String()
+		default:
+			opt.Name = "unknown"
+			opt.Data = hex.EncodeToString(value)
+		}
+
+		options = append(options, opt)
+	}
+
+	return options
+}
+
+// ipv6Addresses returns the IPv6 addresses of a header.
+func ipv6Addresses(data []byte) []string {
+	addresses := make([]string, 0, len(data)/16)
+	for i := 0; i+16 <= len(data); i += 16 {
+		addresses = append(addresses, net.IP(data[i:i+16]).String())
+	}
+	return addresses
+}
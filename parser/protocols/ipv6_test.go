@@ -0,0 +1,219 @@
+package protocols
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// boolPtr returns a pointer to b, for the optional fields of headers.
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestIPv6Options(t *testing.T) {
+	home := net.ParseIP("2001:db8::1")
+
+	tests := []struct {
+		name string
+		data []byte
+		want []IPv6Option
+	}{
+		{"empty", nil, []IPv6Option{}},
+		{"padding", []byte{0, 1, 2, 0, 0, 0}, []IPv6Option{}},
+		{"router alert", []byte{5, 2, 0, 0, 1, 0}, []IPv6Option{{Type: 5, Name: "router_alert", Length: 2, RouterAlert: intPtr(0)}}},
+		{"jumbo payload", []byte{0xc2, 4, 0, 1, 0, 0}, []IPv6Option{
+			{Type: 0xc2, Name: "jumbo_payload", Length: 4, JumboPayloadLength: intPtr(65536)}}},
+		{"tunnel limit", []byte{4, 1, 4, 0}, []IPv6Option{
+			{Type: 4, Name: "tunnel_encapsulation_limit", Length: 1, TunnelLimit: intPtr(4)}}},
+		{"home address", append([]byte{0xc9, 16}, home...), []IPv6Option{
+			{Type: 0xc9, Name: "home_address", Length: 16, HomeAddress: "2001:db8::1"}}},
+		{"unknown", []byte{0x1e, 2, 0xab, 0xcd}, []IPv6Option{{Type: 0x1e, Name: "unknown", Length: 2, Data: "abcd"}}},
+		{"wrong length", []byte{5, 3, 0, 0, 0}, []IPv6Option{{Type: 5, Name: "unknown", Length: 3, Data: "000000"}}},
+		{"empty value", []byte{0xc2, 0}, []IPv6Option{{Type: 0xc2, Name: "unknown", Length: 0}}},
+		{"missing length", []byte{1, 0, 5}, []IPv6Option{{Type: 5, Name: "malformed", Data: "05"}}},
+		{"value beyond header", []byte{5, 2, 0, 0, 0xc9, 16, 0x20}, []IPv6Option{
+			{Type: 5, Name: "router_alert", Length: 2, RouterAlert: intPtr(0)},
+			{Type: 0xc9, Name: "malformed", Data: "c91020"}}},
+	}
+
+	for _, test := range tests {
+		if got := ipv6Options(test.data); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	segment := net.ParseIP("fc00::1")
+	udp := []byte{0x30, 0x39, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00}
+
+	tests := []struct {
+		name    string
+		next    layers.IPProtocol
+		data    []byte
+		headers []IPv6ExtensionHeader
+		upper   layers.IPProtocol
+		rest    []byte
+	}{
+		{"none", layers.IPProtocolUDP, udp, []IPv6ExtensionHeader{}, layers.IPProtocolUDP, udp},
+		{"hop by hop", layers.IPProtocolIPv6HopByHop, append([]byte{17, 0, 5, 2, 0, 0, 1, 0}, udp...),
+			[]IPv6ExtensionHeader{{Type: "hop_by_hop", NextHeader: "UDP", Length: 8,
+				Options: []IPv6Option{{Type: 5, Name: "router_alert", Length: 2, RouterAlert: intPtr(0)}}}},
+			layers.IPProtocolUDP, udp},
+		{"destination options", layers.IPProtocolIPv6Destination, append([]byte{17, 0, 1, 4, 0, 0, 0, 0}, udp...),
+			[]IPv6ExtensionHeader{{Type: "destination_options", NextHeader: "UDP", Length: 8, Options: []IPv6Option{}}},
+			layers.IPProtocolUDP, udp},
+		{"routing type 0", layers.IPProtocolIPv6Routing,
+			append(append([]byte{17, 2, 0, 1, 0, 0, 0, 0}, segment...), udp...),
+			[]IPv6ExtensionHeader{{Type: "routing", NextHeader: "UDP", Length: 24, RoutingType: intPtr(0),
+				SegmentsLeft: intPtr(1), Addresses: []string{"fc00::1"}}},
+			layers.IPProtocolUDP, udp},
+		{"mobile ipv6 routing", layers.IPProtocolIPv6Routing,
+			append(append([]byte{6, 2, 2, 1, 0, 0, 0, 0}, segment...), udp...),
+			[]IPv6ExtensionHeader{{Type: "routing", NextHeader: "TCP", Length: 24, RoutingType: intPtr(2),
+				SegmentsLeft: intPtr(1), Addresses: []string{"fc00::1"}}},
+			layers.IPProtocolTCP, udp},
+		{"segment routing", layers.IPProtocolIPv6Routing,
+			append(append([]byte{17, 2, 4, 0, 0, 0x80, 0, 7}, segment...), udp...),
+			[]IPv6ExtensionHeader{{Type: "routing", NextHeader: "UDP", Length: 24, RoutingType: intPtr(4),
+				SegmentsLeft: intPtr(0), LastEntry: intPtr(0), Flags: intPtr(0x80), Tag: intPtr(7),
+				Addresses: []string{"fc00::1"}}},
+			layers.IPProtocolUDP, udp},
+		{"segment routing with tlvs", layers.IPProtocolIPv6Routing,
+			append(append(append([]byte{17, 3, 4, 0, 0, 0, 0, 0}, segment...), 1, 6, 0, 0, 0, 0, 0, 0), udp...),
+			[]IPv6ExtensionHeader{{Type: "routing", NextHeader: "UDP", Length: 32, RoutingType: intPtr(4),
+				SegmentsLeft: intPtr(0), LastEntry: intPtr(0), Flags: intPtr(0), Tag: intPtr(0),
+				Addresses: []string{"fc00::1"}, Data: "0106000000000000"}},
+			layers.IPProtocolUDP, udp},
+		{"segment list beyond header", layers.IPProtocolIPv6Routing,
+			append(append([]byte{17, 2, 4, 0, 1, 0, 0, 0}, segment...), udp...),
+			[]IPv6ExtensionHeader{{Type: "routing", NextHeader: "UDP", Length: 24, RoutingType: intPtr(4),
+				SegmentsLeft: intPtr(0), LastEntry: intPtr(1), Flags: intPtr(0), Tag: intPtr(0),
+				Data: "fc000000000000000000000000000001"}},
+			layers.IPProtocolUDP, udp},
+		{"unknown routing type", layers.IPProtocolIPv6Routing, append([]byte{17, 0, 253, 0, 1, 2, 3, 4}, udp...),
+			[]IPv6ExtensionHeader{{Type: "routing", NextHeader: "UDP", Length: 8, RoutingType: intPtr(253),
+				SegmentsLeft: intPtr(0), Data: "01020304"}},
+			layers.IPProtocolUDP, udp},
+		{"first fragment", layers.IPProtocolIPv6Fragment, append([]byte{17, 0, 0, 1, 0, 0, 0, 9}, udp...),
+			[]IPv6ExtensionHeader{{Type: "fragment", NextHeader: "UDP", Length: 8, FragmentOffset: intPtr(0),
+				MoreFragments: boolPtr(true), Identification: intPtr(9)}},
+			layers.IPProtocolUDP, udp},
+		{"later fragment", layers.IPProtocolIPv6Fragment, append([]byte{17, 0, 0, 0x08, 0, 0, 0, 9}, udp...),
+			[]IPv6ExtensionHeader{{Type: "fragment", NextHeader: "UDP", Length: 8, FragmentOffset: intPtr(1),
+				MoreFragments: boolPtr(false), Identification: intPtr(9)}},
+			layers.IPProtocolUDP, nil},
+		{"authentication", layers.IPProtocolAH, append([]byte{17, 4, 0, 0, 0, 0, 1, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, udp...),
+			[]IPv6ExtensionHeader{{Type: "authentication", NextHeader: "UDP", Length: 24, SPI: intPtr(256),
+				SequenceNumber: intPtr(2)}},
+			layers.IPProtocolUDP, udp},
+		{"chain", layers.IPProtocolIPv6HopByHop, append([]byte{44, 0, 1, 4, 0, 0, 0, 0, 17, 0, 0, 1, 0, 0, 0, 9}, udp...),
+			[]IPv6ExtensionHeader{
+				{Type: "hop_by_hop", NextHeader: "IPv6Fragment", Length: 8, Options: []IPv6Option{}},
+				{Type: "fragment", NextHeader: "UDP", Length: 8, FragmentOffset: intPtr(0),
+					MoreFragments: boolPtr(true), Identification: intPtr(9)},
+			},
+			layers.IPProtocolUDP, udp},
+		{"truncated header", layers.IPProtocolIPv6HopByHop, []byte{17, 1, 1, 4, 0, 0, 0, 0},
+			[]IPv6ExtensionHeader{}, layers.IPProtocolIPv6HopByHop, []byte{17, 1, 1, 4, 0, 0, 0, 0}},
+		{"short header", layers.IPProtocolIPv6Routing, []byte{17, 0, 4},
+			[]IPv6ExtensionHeader{}, layers.IPProtocolIPv6Routing, []byte{17, 0, 4}},
+	}
+
+	for _, test := range tests {
+		headers, upper, rest := ipv6ExtensionHeaders(test.next, test.data)
+		if !reflect.DeepEqual(headers, test.headers) {
+			t.Errorf("%s: got headers %+v, want %+v", test.name, headers, test.headers)
+		}
+		if upper != test.upper {
+			t.Errorf("%s: got upper layer %v, want %v", test.name, upper, test.upper)
+		}
+		if !reflect.DeepEqual(rest, test.rest) {
+			t.Errorf("%s: got data %x, want %x", test.name, rest, test.rest)
+		}
+	}
+}
+
+// ipv6Packet returns an IPv6 packet with a payload.
+func ipv6Packet(next layers.IPProtocol, payload []byte) []byte {
+	packet := []byte{0x60, 0, 0, 0, byte(len(payload) >> 8), byte(len(payload)), byte(next), 64}
+	packet = append(packet, net.ParseIP("2001:db8::1")...)
+	packet = append(packet, net.ParseIP("fc00::1")...)
+	return append(packet, payload...)
+}
+
+func TestIPv6UpperLayer(t *testing.T) {
+	srh := append([]byte{0, 2, 4, 0, 0, 0, 0, 0}, net.ParseIP("fc00::1")...)
+	udp := []byte{0x30, 0x39, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00}
+	tcp := []byte{0x30, 0x39, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 0, 0x50, 0x02, 0xff, 0xff, 0, 0, 0, 0}
+
+	withNext := func(header []byte, next layers.IPProtocol) []byte {
+		return append([]byte{byte(next)}, header[1:]...)
+	}
+
+	tests := []struct {
+		name  string
+		next  layers.IPProtocol
+		data  []byte
+		layer gopacket.LayerType
+	}{
+		{"udp after segment routing", layers.IPProtocolIPv6Routing,
+			append(withNext(srh, layers.IPProtocolUDP), udp...), layers.LayerTypeUDP},
+		{"tcp after segment routing", layers.IPProtocolIPv6Routing,
+			append(withNext(srh, layers.IPProtocolTCP), tcp...), layers.LayerTypeTCP},
+		{"udp", layers.IPProtocolUDP, udp, layers.LayerTypeUDP},
+		{"icmpv6 after segment routing", layers.IPProtocolIPv6Routing,
+			append(withNext(srh, layers.IPProtocolICMPv6), 128, 0, 0, 0), gopacket.LayerTypeZero},
+		{"no upper layer data", layers.IPProtocolIPv6Routing, withNext(srh, layers.IPProtocolUDP), gopacket.LayerTypeZero},
+		{"later fragment", layers.IPProtocolIPv6Fragment, append([]byte{17, 0, 0, 0x08, 0, 0, 0, 9}, udp...),
+			gopacket.LayerTypeZero},
+	}
+
+	for _, test := range tests {
+		packet := gopacket.NewPacket(ipv6Packet(test.next, test.data), layers.LayerTypeIPv6, gopacket.Default)
+		layer := packet.Layer(layers.LayerTypeIPv6)
+		if layer == nil {
+			t.Errorf("%s: not decoded: %v", test.name, packet.ErrorLayer().Error())
+			continue
+		}
+
+		upper := IPv6UpperLayer(layer)
+		if test.layer == gopacket.LayerTypeZero {
+			if upper != nil {
+				t.Errorf("%s: got layers %v, want none", test.name, upper.Layers())
+			}
+			continue
+		}
+		if upper == nil || upper.Layer(test.layer) == nil {
+			t.Errorf("%s: no %v layer", test.name, test.layer)
+		}
+	}
+}
+
+func TestIPv6Parser(t *testing.T) {
+	data := append([]byte{43, 0, 5, 2, 0, 0, 1, 0, 17, 2, 4, 0, 0, 0, 0, 0}, net.ParseIP("fc00::1")...)
+	data = append(data, 0x30, 0x39, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00)
+
+	packet := gopacket.NewPacket(ipv6Packet(layers.IPProtocolIPv6HopByHop, data), layers.LayerTypeIPv6, gopacket.Default)
+	layer := packet.Layer(layers.LayerTypeIPv6)
+	if layer == nil {
+		t.Fatalf("not decoded: %v", packet.ErrorLayer().Error())
+	}
+
+	header := IPv6Parser(layer)
+	if header.Version != 6 || header.Length != len(data) || header.HopLimit != 64 ||
+		header.SourceAddress != "2001:db8::1" || header.DestAddress != "fc00::1" {
+		t.Errorf("got header %+v", header)
+	}
+	if header.NextHeader != "IPv6HopByHop" || header.UpperLayer != "UDP" {
+		t.Errorf("got next header %s and upper layer %s, want IPv6HopByHop and UDP", header.NextHeader, header.UpperLayer)
+	}
+	if len(header.ExtensionHeaders) != 2 || header.ExtensionHeaders[0].Type != "hop_by_hop" ||
+		header.ExtensionHeaders[1].Type != "routing" {
+		t.Errorf("got extension headers %+v", header.ExtensionHeaders)
+	}
+}
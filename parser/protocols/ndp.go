@@ -0,0 +1,144 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// Neighbor Discovery option types
+const (
+	ndpOptionSourceLinkLayerAddress = 1
+	ndpOptionTargetLinkLayerAddress = 2
+	ndpOptionPrefixInformation      = 3
+	ndpOptionRedirectedHeader       = 4
+	ndpOptionMTU                    = 5
+	ndpOptionRDNSS                  = 25
+	ndpOptionDNSSL                  = 31
+)
+
+// ICMPv6Option represents a Neighbor Discovery option. Only the fields of
+// its type are set, and unknown options hold their data as hex.
+type ICMPv6Option struct {
+	Type              int      `json:"type"`
+	Name              string   `json:"name"`
+	Length            int      `json:"length"`
+	LinkLayerAddress  string   `json:"link_layer_address,omitempty"`
+	PrefixLength      *int     `json:"prefix_length,omitempty"`
+	Flags             []string `json:"flags,omitempty"`
+	ValidLifetime     *int     `json:"valid_lifetime,omitempty"`
+	PreferredLifetime *int     `json:"preferred_lifetime,omitempty"`
+	Prefix            string   `json:"prefix,omitempty"`
+	MTU               *int     `json:"mtu,omitempty"`
+	Lifetime          *int     `json:"lifetime,omitempty"`
+	Addresses         []string `json:"addresses,omitempty"`
+	Domains           []string `json:"domains,omitempty"`
+	Data              string   `json:"data,omitempty"`
+}
+
+// icmpv6Options parses the Neighbor Discovery options of an ICMPv6
+// message. Their length is given in units of 8 bytes.
+func icmpv6Options(data []byte) []ICMPv6Option {
+	options := make([]ICMPv6Option, 0)
+
+	for len(data) >= 2 {
+		length := int(data[1]) * 8
+		if length == 0 || length > len(data) {
+			options = append(options, ICMPv6Option{Type: int(data[0]), Name: "malformed", Data: hex.EncodeToString(data)})
+			break
+		}
+
+		opt := ICMPv6Option{
+			Type:   int(data[0]),
+			Length: length,
+		}
+		value := data[2:length]
+		data = data[length:]
+
+		switch {
+		case opt.Type == ndpOptionSourceLinkLayerAddress || opt.Type == ndpOptionTargetLinkLayerAddress:
+			opt.Name = "source_link_layer_address"
+			if opt.Type == ndpOptionTargetLinkLayerAddress {
+				opt.Name = "target_link_layer_address"
+			}
+			// Ethernet addresses are padded to 8 bytes
+			if len(value) == 6 {
+				opt.LinkLayerAddress = net.HardwareAddr(value).String()
+			} else {
+				opt.LinkLayerAddress = hex.EncodeToString(value)
+			}
+		case opt.Type == ndpOptionPrefixInformation && len(value) == 30:
+			opt.Name = "prefix_information"
+			prefixLength := int(value[0])
+			valid := int(binary.BigEndian.Uint32(value[2:]))
+			preferred := int(binary.BigEndian.Uint32(value[6:]))
+			opt.PrefixLength = &prefixLength
+			opt.ValidLifetime = &valid
+			opt.PreferredLifetime = &preferred
+			opt.Prefix = net.IP(value[14:30]).String()
+
+			opt.Flags = make([]string, 0, 3)
+			if value[1]&0x80 != 0 {
+				opt.Flags = append(opt.Flags, "L")
+			}
+			if value[1]&0x40 != 0 {
+				opt.Flags = append(opt.Flags, "A")
+			}
+			if value[1]&0x20 != 0 {
+				opt.Flags = append(opt.Flags, "R")
+			}
+		case opt.Type == ndpOptionRedirectedHeader:
+			// The redirected packet itself is left out
+			opt.Name = "redirected_header"
+		case opt.Type == ndpOptionMTU && len(value) == 6:
+			opt.Name = "mtu"
+			mtu := int(binary.BigEndian.Uint32(value[2:]))
+			opt.MTU = &mtu
+		case opt.Type == ndpOptionRDNSS && len(value) >= 6:
+			opt.Name = "rdnss"
+			lifetime := int(binary.BigEndian.Uint32(value[2:]))
+			opt.Lifetime = &lifetime
+			opt.Addresses = ipv6Addresses(value[6:])
+		case opt.Type == ndpOptionDNSSL && len(value) >= 6:
+			opt.Name = "dnssl"
+			lifetime := int(binary.BigEndian.Uint32(value[2:]))
+			opt.Lifetime = &lifetime
+			opt.Domains = dnsslDomains(value[6:])
+		default:
+			opt.Name = "unknown"
+			opt.Data = hex.EncodeToString(value)
+		}
+
+		options = append(options, opt)
+	}
+
+	return options
+}
+
+// dnsslDomains returns the domain names of a DNS Search List option, which
+// are encoded as in DNS messages without compression and padded with
+// zeros.
+func dnsslDomains(data []byte) []string {
+	domains := make([]string, 0)
+
+	var labels []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if n == 0 {
+			if len(labels) > 0 {
+				domains = append(domains, strings.Join(labels, ".")+".")
+				labels = nil
+			}
+			data = data[1:]
+			continue
+		}
+		if 1+n > len(data) {
+			break
+		}
+		labels = append(labels, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+
+	return domains
+}
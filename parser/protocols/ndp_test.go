@@ -0,0 +1,79 @@
+package protocols
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestICMPv6Options(t *testing.T) {
+	prefix := []byte{3, 4, 64, 0xc0, 0, 0, 0x0e, 0x10, 0, 0, 0x07, 0x08, 0, 0, 0, 0}
+	prefix = append(prefix, net.ParseIP("2001:db8::")...)
+	rdnss := append([]byte{25, 5, 0, 0, 0, 0, 0x0e, 0x10}, net.ParseIP("2001:db8::53")...)
+	rdnss = append(rdnss, net.ParseIP("2001:db8::54")...)
+	dnssl := []byte{31, 3, 0, 0, 0, 0, 0, 60, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 0, 0}
+
+	tests := []struct {
+		name string
+		data []byte
+		want []ICMPv6Option
+	}{
+		{"empty", nil, []ICMPv6Option{}},
+		{"source link-layer address", []byte{1, 1, 0, 1, 2, 3, 4, 5}, []ICMPv6Option{
+			{Type: 1, Name: "source_link_layer_address", Length: 8, LinkLayerAddress: "00:01:02:03:04:05"}}},
+		{"target link-layer address", []byte{2, 1, 0, 1, 2, 3, 4, 5}, []ICMPv6Option{
+			{Type: 2, Name: "target_link_layer_address", Length: 8, LinkLayerAddress: "00:01:02:03:04:05"}}},
+		{"long link-layer address", []byte{1, 2, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}, []ICMPv6Option{
+			{Type: 1, Name: "source_link_layer_address", Length: 16, LinkLayerAddress: "000102030405060708090a0b0c0d"}}},
+		{"prefix information", prefix, []ICMPv6Option{
+			{Type: 3, Name: "prefix_information", Length: 32, PrefixLength: intPtr(64), Flags: []string{"L", "A"},
+				ValidLifetime: intPtr(3600), PreferredLifetime: intPtr(1800), Prefix: "2001:db8::"}}},
+		{"short prefix information", []byte{3, 1, 64, 0xc0, 0, 0, 0x0e, 0x10}, []ICMPv6Option{
+			{Type: 3, Name: "unknown", Length: 8, Data: "40c000000e10"}}},
+		{"redirected header", []byte{4, 1, 0, 0, 0, 0, 0, 0}, []ICMPv6Option{
+			{Type: 4, Name: "redirected_header", Length: 8}}},
+		{"mtu", []byte{5, 1, 0, 0, 0, 0, 0x05, 0xdc}, []ICMPv6Option{{Type: 5, Name: "mtu", Length: 8, MTU: intPtr(1500)}}},
+		{"long mtu", []byte{5, 2, 0, 0, 0, 0, 0x05, 0xdc, 0, 0, 0, 0, 0, 0, 0, 0}, []ICMPv6Option{
+			{Type: 5, Name: "unknown", Length: 16, Data: "0000000005dc0000000000000000"}}},
+		{"rdnss", rdnss, []ICMPv6Option{{Type: 25, Name: "rdnss", Length: 40, Lifetime: intPtr(3600),
+			Addresses: []string{"2001:db8::53", "2001:db8::54"}}}},
+		{"rdnss without addresses", []byte{25, 1, 0, 0, 0, 0, 0, 0}, []ICMPv6Option{
+			{Type: 25, Name: "rdnss", Length: 8, Lifetime: intPtr(0), Addresses: []string{}}}},
+		{"dnssl", dnssl, []ICMPv6Option{{Type: 31, Name: "dnssl", Length: 24, Lifetime: intPtr(60),
+			Domains: []string{"example.com."}}}},
+		{"unknown", []byte{99, 1, 1, 2, 3, 4, 5, 6}, []ICMPv6Option{{Type: 99, Name: "unknown", Length: 8, Data: "010203040506"}}},
+		{"zero length", []byte{1, 0, 0, 1, 2, 3, 4, 5}, []ICMPv6Option{{Type: 1, Name: "malformed", Data: "0100000102030405"}}},
+		{"beyond message", []byte{5, 1, 0, 0, 0, 0, 0x05, 0xdc, 1, 2, 0, 1, 2, 3}, []ICMPv6Option{
+			{Type: 5, Name: "mtu", Length: 8, MTU: intPtr(1500)},
+			{Type: 1, Name: "malformed", Data: "010200010203"}}},
+		{"trailing byte", []byte{5, 1, 0, 0, 0, 0, 0x05, 0xdc, 1}, []ICMPv6Option{
+			{Type: 5, Name: "mtu", Length: 8, MTU: intPtr(1500)}}},
+	}
+
+	for _, test := range tests {
+		if got := icmpv6Options(test.data); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDNSSLDomains(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"empty", nil, []string{}},
+		{"padding", []byte{0, 0, 0}, []string{}},
+		{"one domain", []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0}, []string{"example.com."}},
+		{"two domains", []byte{1, 'a', 0, 1, 'b', 3, 'n', 'e', 't', 0}, []string{"a.", "b.net."}},
+		{"unterminated", []byte{1, 'a', 0, 1, 'b'}, []string{"a."}},
+		{"label beyond data", []byte{1, 'a', 0, 9, 'b'}, []string{"a."}},
+	}
+
+	for _, test := range tests {
+		if got := dnsslDomains(test.data); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
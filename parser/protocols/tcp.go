@@ -1,22 +1,121 @@
 package protocols
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// TCP option kinds
+const (
+	tcpOptionEOL           = 0
+	tcpOptionNOP           = 1
+	tcpOptionMSS           = 2
+	tcpOptionWindowScale   = 3
+	tcpOptionSACKPermitted = 4
+	tcpOptionSACK          = 5
+	tcpOptionTimestamps    = 8
+	tcpOptionMD5           = 19
+	tcpOptionFastOpen      = 34
+	// Experimental option used by TCP Fast Open before kind 34 was assigned
+	tcpOptionExperimental = 254
+)
+
+// Magic number of TCP Fast Open experimental options
+const tcpFastOpenMagic = 0xf989
+
 // TCPHeader repesents a TCP segment header
 type TCPHeader struct {
-	SourcePort     int      `json:"source_port"`
-	DestPort       int      `json:"destination_port"`
-	SequenceNumber int      `json:"sequence_number"`
-	AckNumber      int      `json:"ack_number"`
-	DataOffset     int      `json:"data_offset"`
-	Flags          []string `json:"flags"`
-	WindowSize     int      `json:"window_size"`
-	Checksum       int      `json:"checksum"`
-	Urgent         int      `json:"urgent_pointer"`
-	//Options
+	SourcePort     int         `json:"source_port"`
+	DestPort       int         `json:"destination_port"`
+	SequenceNumber int         `json:"sequence_number"`
+	AckNumber      int         `json:"ack_number"`
+	DataOffset     int         `json:"data_offset"`
+	Flags          []string    `json:"flags"`
+	WindowSize     int         `json:"window_size"`
+	Checksum       int         `json:"checksum"`
+	Urgent         int         `json:"urgent_pointer"`
+	Options        []TCPOption `json:"options"`
+}
+
+// TCPOption represents a TCP option. Unknown and malformed options hold
+// their data as hex.
+type TCPOption struct {
+	Kind        int            `json:"kind"`
+	Name        string         `json:"name"`
+	Length      int            `json:"length"`
+	MSS         *int           `json:"mss,omitempty"`
+	WindowScale *int           `json:"window_scale,omitempty"`
+	SACKBlocks  []TCPSACKBlock `json:"sack_blocks,omitempty"`
+	TSVal       *int           `json:"tsval,omitempty"`
+	TSEcr       *int           `json:"tsecr,omitempty"`
+	Cookie      string         `json:"cookie,omitempty"`
+	Signature   string         `json:"signature,omitempty"`
+	Data        string         `json:"data,omitempty"`
+}
+
+// TCPSACKBlock represents a block of data received out of order
+type TCPSACKBlock struct {
+	Left  int `json:"left_edge"`
+	Right int `json:"right_edge"`
+}
+
+// tcpOptionParser parses a TCP option
+func tcpOptionParser(option layers.TCPOption) TCPOption {
+	opt := TCPOption{
+		Kind:   int(option.OptionType),
+		Length: int(option.OptionLength),
+	}
+	data := option.OptionData
+
+	switch {
+	case option.OptionType == tcpOptionEOL:
+		opt.Name = "eol"
+	case option.OptionType == tcpOptionNOP:
+		opt.Name = "nop"
+	case option.OptionType == tcpOptionMSS && len(data) == 2:
+		opt.Name = "mss"
+		mss := int(binary.BigEndian.Uint16(data))
+		opt.MSS = &mss
+	case option.OptionType == tcpOptionWindowScale && len(data) == 1:
+		opt.Name = "window_scale"
+		shift := int(data[0])
+		opt.WindowScale = &shift
+	case option.OptionType == tcpOptionSACKPermitted && len(data) == 0:
+		opt.Name = "sack_permitted"
+	case option.OptionType == tcpOptionSACK && len(data) > 0 && len(data)%8 == 0:
+		opt.Name = "sack"
+		for i := 0; i < len(data); i += 8 {
+			opt.SACKBlocks = append(opt.SACKBlocks, TCPSACKBlock{
+				Left:  int(binary.BigEndian.Uint32(data[i:])),
+				Right: int(binary.BigEndian.Uint32(data[i+4:])),
+			})
+		}
+	case option.OptionType == tcpOptionTimestamps && len(data) == 8:
+		opt.Name = "timestamps"
+		tsval := int(binary.BigEndian.Uint32(data))
+		tsecr := int(binary.BigEndian.Uint32(data[4:]))
+		opt.TSVal = &tsval
+		opt.TSEcr = &tsecr
+	case option.OptionType == tcpOptionMD5 && len(data) == 16:
+		opt.Name = "md5"
+		opt.Signature = hex.EncodeToString(data)
+	case option.OptionType == tcpOptionFastOpen:
+		// An empty cookie requests one
+		opt.Name = "tfo"
+		opt.Cookie = hex.EncodeToString(data)
+	case option.OptionType == tcpOptionExperimental && len(data) >= 2 &&
+		binary.BigEndian.Uint16(data) == tcpFastOpenMagic:
+		opt.Name = "tfo"
+		opt.Cookie = hex.EncodeToString(data[2:])
+	default:
+		opt.Name = "unknown"
+		opt.Data = hex.EncodeToString(data)
+	}
+
+	return opt
 }
 
 // TCPParser parses a TCP segment header
@@ -53,6 +152,15 @@ func TCPParser(layer gopacket.Layer) TCPHeader {
 		tcpFlags = append(tcpFlags, "NS")
 	}
 
+	tcpOptions := make([]TCPOption, 0, len(tcp.Options))
+	for _, option := range tcp.Options {
+		tcpOptions = append(tcpOptions, tcpOptionParser(option))
+		// What follows the end of the option list is padding
+		if option.OptionType == tcpOptionEOL {
+			break
+		}
+	}
+
 	tcpHeader := TCPHeader{
 		SourcePort:     int(tcp.SrcPort),
 		DestPort:       int(tcp.DstPort),
@@ -63,6 +171,7 @@ func TCPParser(layer gopacket.Layer) TCPHeader {
 		WindowSize:     int(tcp.Window),
 		Checksum:       int(tcp.Checksum),
 		Urgent:         int(tcp.Urgent),
+		Options:        tcpOptions,
 	}
 
 	return tcpHeader
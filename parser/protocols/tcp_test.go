@@ -0,0 +1,156 @@
+package protocols
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// intPtr returns a pointer to n, for the optional fields of headers.
+func intPtr(n int) *int {
+	return &n
+}
+
+func TestTCPOptionParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		option layers.TCPOption
+		want   TCPOption
+	}{
+		{"eol", layers.TCPOption{OptionType: 0, OptionLength: 1},
+			TCPOption{Kind: 0, Name: "eol", Length: 1}},
+		{"nop", layers.TCPOption{OptionType: 1, OptionLength: 1},
+			TCPOption{Kind: 1, Name: "nop", Length: 1}},
+		{"mss", layers.TCPOption{OptionType: 2, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			TCPOption{Kind: 2, Name: "mss", Length: 4, MSS: intPtr(1460)}},
+		{"short mss", layers.TCPOption{OptionType: 2, OptionLength: 3, OptionData: []byte{0x05}},
+			TCPOption{Kind: 2, Name: "unknown", Length: 3, Data: "05"}},
+		{"window scale", layers.TCPOption{OptionType: 3, OptionLength: 3, OptionData: []byte{7}},
+			TCPOption{Kind: 3, Name: "window_scale", Length: 3, WindowScale: intPtr(7)}},
+		{"long window scale", layers.TCPOption{OptionType: 3, OptionLength: 4, OptionData: []byte{7, 0}},
+			TCPOption{Kind: 3, Name: "unknown", Length: 4, Data: "0700"}},
+		{"sack permitted", layers.TCPOption{OptionType: 4, OptionLength: 2},
+			TCPOption{Kind: 4, Name: "sack_permitted", Length: 2}},
+		{"sack permitted with data", layers.TCPOption{OptionType: 4, OptionLength: 3, OptionData: []byte{1}},
+			TCPOption{Kind: 4, Name: "unknown", Length: 3, Data: "01"}},
+		{"sack", layers.TCPOption{OptionType: 5, OptionLength: 18,
+			OptionData: []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 1, 0, 0, 0, 2, 0}},
+			TCPOption{Kind: 5, Name: "sack", Length: 18, SACKBlocks: []TCPSACKBlock{{1, 2}, {256, 512}}}},
+		{"truncated sack", layers.TCPOption{OptionType: 5, OptionLength: 6, OptionData: []byte{0, 0, 0, 1}},
+			TCPOption{Kind: 5, Name: "unknown", Length: 6, Data: "00000001"}},
+		{"empty sack", layers.TCPOption{OptionType: 5, OptionLength: 2},
+			TCPOption{Kind: 5, Name: "unknown", Length: 2}},
+		{"timestamps", layers.TCPOption{OptionType: 8, OptionLength: 10, OptionData: []byte{0, 0, 0, 10, 0, 0, 0, 20}},
+			TCPOption{Kind: 8, Name: "timestamps", Length: 10, TSVal: intPtr(10), TSEcr: intPtr(20)}},
+		{"short timestamps", layers.TCPOption{OptionType: 8, OptionLength: 6, OptionData: []byte{0, 0, 0, 10}},
+			TCPOption{Kind: 8, Name: "unknown", Length: 6, Data: "0000000a"}},
+		{"md5", layers.TCPOption{OptionType: 19, OptionLength: 18, OptionData: make([]byte, 16)},
+			TCPOption{Kind: 19, Name: "md5", Length: 18, Signature: "00000000000000000000000000000000"}},
+		{"short md5", layers.TCPOption{OptionType: 19, OptionLength: 4, OptionData: []byte{1, 2}},
+			TCPOption{Kind: 19, Name: "unknown", Length: 4, Data: "0102"}},
+		{"fast open", layers.TCPOption{OptionType: 34, OptionLength: 6, OptionData: []byte{0xde, 0xad, 0xbe, 0xef}},
+			TCPOption{Kind: 34, Name: "tfo", Length: 6, Cookie: "deadbeef"}},
+		{"fast open request", layers.TCPOption{OptionType: 34, OptionLength: 2},
+			TCPOption{Kind: 34, Name: "tfo", Length: 2}},
+		{"experimental fast open", layers.TCPOption{OptionType: 254, OptionLength: 8,
+			OptionData: []byte{0xf9, 0x89, 0xde, 0xad, 0xbe, 0xef}},
+			TCPOption{Kind: 254, Name: "tfo", Length: 8, Cookie: "deadbeef"}},
+		{"other experimental", layers.TCPOption{OptionType: 254, OptionLength: 4, OptionData: []byte{0x12, 0x34}},
+			TCPOption{Kind: 254, Name: "unknown", Length: 4, Data: "1234"}},
+		{"short experimental", layers.TCPOption{OptionType: 254, OptionLength: 3, OptionData: []byte{0xf9}},
+			TCPOption{Kind: 254, Name: "unknown", Length: 3, Data: "f9"}},
+		{"unknown", layers.TCPOption{OptionType: 99, OptionLength: 3, OptionData: []byte{0xff}},
+			TCPOption{Kind: 99, Name: "unknown", Length: 3, Data: "ff"}},
+	}
+
+	for _, test := range tests {
+		if got := tcpOptionParser(test.option); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// tcpSegment returns a TCP header with options, without payload.
+func tcpSegment(flags byte, options []byte) []byte {
+	offset := (20 + len(options)) / 4
+	segment := []byte{
+		0x30, 0x39, 0x00, 0x50, // ports 12345 and 80
+		0x00, 0x00, 0x00, 0x01, // sequence number
+		0x00, 0x00, 0x00, 0x02, // ack number
+		byte(offset << 4), flags,
+		0xff, 0xff, // window
+		0x12, 0x34, // checksum
+		0x00, 0x00, // urgent pointer
+	}
+	return append(segment, options...)
+}
+
+func TestTCPParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		segment []byte
+		flags   []string
+		options []TCPOption
+	}{
+		{"no options", tcpSegment(0x02, nil), []string{"SYN"}, []TCPOption{}},
+		{"options", tcpSegment(0x12, []byte{2, 4, 0x05, 0xb4, 1, 1, 4, 2}), []string{"SYN", "ACK"}, []TCPOption{
+			{Kind: 2, Name: "mss", Length: 4, MSS: intPtr(1460)},
+			{Kind: 1, Name: "nop", Length: 1},
+			{Kind: 1, Name: "nop", Length: 1},
+			{Kind: 4, Name: "sack_permitted", Length: 2},
+		}},
+		{"padding after eol", tcpSegment(0x11, []byte{3, 3, 7, 0, 0x99, 0x99, 0x99, 0x99}), []string{"FIN", "ACK"}, []TCPOption{
+			{Kind: 3, Name: "window_scale", Length: 3, WindowScale: intPtr(7)},
+			{Kind: 0, Name: "eol", Length: 1},
+		}},
+	}
+
+	for _, test := range tests {
+		packet := gopacket.NewPacket(test.segment, layers.LayerTypeTCP, gopacket.Default)
+		layer := packet.Layer(layers.LayerTypeTCP)
+		if layer == nil {
+			t.Errorf("%s: not decoded: %v", test.name, packet.ErrorLayer().Error())
+			continue
+		}
+
+		header := TCPParser(layer)
+		if header.SourcePort != 12345 || header.DestPort != 80 || header.SequenceNumber != 1 || header.AckNumber != 2 ||
+			header.WindowSize != 65535 || header.Checksum != 0x1234 {
+			t.Errorf("%s: got header %+v", test.name, header)
+		}
+		if header.DataOffset != len(test.segment)/4 {
+			t.Errorf("%s: got data offset %d, want %d", test.name, header.DataOffset, len(test.segment)/4)
+		}
+		if !reflect.DeepEqual(header.Flags, test.flags) {
+			t.Errorf("%s: got flags %v, want %v", test.name, header.Flags, test.flags)
+		}
+		if !reflect.DeepEqual(header.Options, test.options) {
+			t.Errorf("%s: got options %+v, want %+v", test.name, header.Options, test.options)
+		}
+	}
+}
+
+func TestTCPTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		segment []byte
+	}{
+		{"short header", tcpSegment(0x02, nil)[:12]},
+		{"option beyond header", tcpSegment(0x02, []byte{2, 8, 0x05, 0xb4})},
+		{"data offset beyond segment", append(tcpSegment(0x02, nil)[:12], 0xf0, 0x02, 0, 0, 0, 0, 0, 0)},
+	}
+
+	for _, test := range tests {
+		packet := gopacket.NewPacket(test.segment, layers.LayerTypeTCP, gopacket.Default)
+		if layer := packet.Layer(layers.LayerTypeTCP); layer != nil {
+			// Whatever gopacket decodes must not make the parser panic
+			TCPParser(layer)
+			continue
+		}
+		if packet.ErrorLayer() == nil {
+			t.Errorf("%s: expected a decoding error", test.name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Package pcapng implements a native reader and writer for the pcapng capture
+file format, keeping the per-interface metadata that classic pcap files lack.
+
+See https://github.com/pcapng/pcapng for the format specification.
+*/
+package pcapng
+
+import (
+	"errors"
+	"math/bits"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Block types
+const (
+	blockTypeInterfaceDescription uint32 = 0x00000001
+	blockTypePacket               uint32 = 0x00000002
+	blockTypeSimplePacket         uint32 = 0x00000003
+	blockTypeInterfaceStatistics  uint32 = 0x00000005
+	blockTypeEnhancedPacket       uint32 = 0x00000006
+	blockTypeSectionHeader        uint32 = 0x0A0D0D0A
+)
+
+// Option codes
+const (
+	optEndOfOpt uint16 = 0
+	optComment  uint16 = 1
+
+	optSHBUserAppl uint16 = 4
+
+	optIFName        uint16 = 2
+	optIFDescription uint16 = 3
+	optIFTSResol     uint16 = 9
+	optIFTSOffset    uint16 = 14
+
+	optEPBDropCount uint16 = 4
+
+	optISBStartTime    uint16 = 2
+	optISBEndTime      uint16 = 3
+	optISBIFRecv       uint16 = 4
+	optISBIFDrop       uint16 = 5
+	optISBFilterAccept uint16 = 6
+	optISBOSDrop       uint16 = 7
+	optISBUsrDeliv     uint16 = 8
+)
+
+const byteOrderMagic uint32 = 0x1A2B3C4D
+
+// Default timestamp resolution of an interface (microseconds)
+const defaultTSResol uint8 = 6
+
+// Largest block accepted by the reader, to guard against corrupt files
+const maxBlockLen = 64 * 1024 * 1024
+
+var (
+	// ErrNotPCAPNG is returned when the input does not start with a
+	// section header block.
+	ErrNotPCAPNG = errors.New("pcapng: not a pcapng file")
+	// ErrBadBlock is returned when a block is malformed.
+	ErrBadBlock = errors.New("pcapng: malformed block")
+	// ErrUnknownInterface is returned when a block refers to an interface
+	// that has not been described.
+	ErrUnknownInterface = errors.New("pcapng: unknown interface")
+)
+
+// Interface describes a capture interface from an Interface Description Block.
+type Interface struct {
+	Name        string
+	Description string
+	LinkType    layers.LinkType
+	SnapLen     uint32
+	// TimestampResolution is the raw if_tsresol value. If the most
+	// significant bit is clear it is a negative power of 10, otherwise
+	// a negative power of 2.
+	TimestampResolution uint8
+	TimestampOffset     int64
+	// Statistics holds the most recent Interface Statistics Block read
+	// for the interface, or nil if none has been read.
+	Statistics *InterfaceStatistics
+}
+
+// InterfaceStatistics holds the counters of an Interface Statistics Block.
+// Counters that are not present in the block are nil.
+type InterfaceStatistics struct {
+	Timestamp      time.Time
+	StartTime      *time.Time
+	EndTime        *time.Time
+	Received       *uint64
+	Dropped        *uint64
+	FilterAccepted *uint64
+	OSDropped      *uint64
+	Delivered      *uint64
+	Comments       []string
+}
+
+// Packet is a packet read from a pcapng file.
+type Packet struct {
+	Data           []byte
+	CaptureInfo    gopacket.CaptureInfo
+	InterfaceIndex int
+	Comments       []string
+	// DropCount is the number of packets lost between this packet and the
+	// preceding one, or nil if not recorded.
+	DropCount *uint64
+}
+
+// unitsPerSecond returns the number of timestamp units per second for a
+// raw if_tsresol value.
+func unitsPerSecond(resol uint8) uint64 {
+	if resol&0x80 != 0 {
+		return 1 << (resol & 0x7f)
+	}
+
+	units := uint64(1)
+	for i := uint8(0); i < resol; i++ {
+		units *= 10
+	}
+	return units
+}
+
+// ticksToTime converts a timestamp in interface units to a time.
+func ticksToTime(ticks uint64, resol uint8, offset int64) time.Time {
+	units := unitsPerSecond(resol)
+	secs := ticks / units
+	hi, lo := bits.Mul64(ticks%units, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, units)
+
+	return time.Unix(int64(secs)+offset, int64(nanos))
+}
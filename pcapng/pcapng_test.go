@@ -0,0 +1,327 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func uint64p(v uint64) *uint64 { return &v }
+
+func TestRoundtrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interfaces := []Interface{
+		{Name: "eth0", Description: "uplink", LinkType: layers.LinkTypeEthernet, SnapLen: 65535},
+		{Name: "lo", LinkType: layers.LinkTypeLinuxSLL, SnapLen: 262144},
+	}
+	for i, iface := range interfaces {
+		index, err := w.AddInterface(iface)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != i {
+			t.Fatalf("AddInterface returned %d, want %d", index, i)
+		}
+	}
+
+	start := time.Unix(1500000000, 0)
+	packets := []struct {
+		ifIndex  int
+		ci       gopacket.CaptureInfo
+		data     []byte
+		comments []string
+	}{
+		{0, gopacket.CaptureInfo{Timestamp: start.Add(123456789), CaptureLength: 3, Length: 60}, []byte{1, 2, 3}, nil},
+		{1, gopacket.CaptureInfo{Timestamp: start.Add(time.Second), CaptureLength: 4, Length: 4}, []byte{4, 5, 6, 7}, []string{"first", "second comment"}},
+		{0, gopacket.CaptureInfo{Timestamp: start.Add(2 * time.Second), CaptureLength: 0, Length: 0}, []byte{}, nil},
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.ifIndex, p.ci, p.data, p.comments...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	end := start.Add(3 * time.Second)
+	stats := []InterfaceStatistics{
+		{
+			Timestamp: end,
+			StartTime: &start,
+			EndTime:   &end,
+			Received:  uint64p(10),
+			Dropped:   uint64p(2),
+			OSDropped: uint64p(1),
+			Comments:  []string{"eth0 stats"},
+		},
+		{
+			Timestamp:      end,
+			Received:       uint64p(1 << 40),
+			FilterAccepted: uint64p(5),
+			Delivered:      uint64p(4),
+		},
+	}
+	for i, s := range stats {
+		if err := w.WriteInterfaceStatistics(i, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range packets {
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if p.InterfaceIndex != want.ifIndex {
+			t.Errorf("packet %d: interface %d, want %d", i, p.InterfaceIndex, want.ifIndex)
+		}
+		if !p.CaptureInfo.Timestamp.Equal(want.ci.Timestamp) {
+			t.Errorf("packet %d: timestamp %v, want %v", i, p.CaptureInfo.Timestamp, want.ci.Timestamp)
+		}
+		if p.CaptureInfo.CaptureLength != want.ci.CaptureLength || p.CaptureInfo.Length != want.ci.Length {
+			t.Errorf("packet %d: lengths %d/%d, want %d/%d", i, p.CaptureInfo.CaptureLength,
+				p.CaptureInfo.Length, want.ci.CaptureLength, want.ci.Length)
+		}
+		if !bytes.Equal(p.Data, want.data) {
+			t.Errorf("packet %d: data %v, want %v", i, p.Data, want.data)
+		}
+		if !reflect.DeepEqual(p.Comments, want.comments) {
+			t.Errorf("packet %d: comments %q, want %q", i, p.Comments, want.comments)
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("got %v after the last packet, want EOF", err)
+	}
+
+	got := r.Interfaces()
+	if len(got) != len(interfaces) {
+		t.Fatalf("read %d interfaces, want %d", len(got), len(interfaces))
+	}
+	for i, iface := range interfaces {
+		if got[i].Name != iface.Name || got[i].Description != iface.Description ||
+			got[i].LinkType != iface.LinkType || got[i].SnapLen != iface.SnapLen {
+			t.Errorf("interface %d: got %+v, want %+v", i, got[i], iface)
+		}
+		if got[i].TimestampResolution != writerTSResol {
+			t.Errorf("interface %d: resolution %d, want %d", i, got[i].TimestampResolution, writerTSResol)
+		}
+
+		s := got[i].Statistics
+		if s == nil {
+			t.Errorf("interface %d: no statistics", i)
+			continue
+		}
+		if !s.Timestamp.Equal(stats[i].Timestamp) {
+			t.Errorf("interface %d: statistics timestamp %v, want %v", i, s.Timestamp, stats[i].Timestamp)
+		}
+		if (s.StartTime == nil) != (stats[i].StartTime == nil) || s.StartTime != nil && !s.StartTime.Equal(*stats[i].StartTime) {
+			t.Errorf("interface %d: start time %v, want %v", i, s.StartTime, stats[i].StartTime)
+		}
+		if (s.EndTime == nil) != (stats[i].EndTime == nil) || s.EndTime != nil && !s.EndTime.Equal(*stats[i].EndTime) {
+			t.Errorf("interface %d: end time %v, want %v", i, s.EndTime, stats[i].EndTime)
+		}
+		counters := []struct {
+			name      string
+			got, want *uint64
+		}{
+			{"received", s.Received, stats[i].Received},
+			{"dropped", s.Dropped, stats[i].Dropped},
+			{"filter accepted", s.FilterAccepted, stats[i].FilterAccepted},
+			{"os dropped", s.OSDropped, stats[i].OSDropped},
+			{"delivered", s.Delivered, stats[i].Delivered},
+		}
+		for _, c := range counters {
+			if !reflect.DeepEqual(c.got, c.want) {
+				t.Errorf("interface %d: %s counter differs", i, c.name)
+			}
+		}
+		if !reflect.DeepEqual(s.Comments, stats[i].Comments) {
+			t.Errorf("interface %d: statistics comments %q, want %q", i, s.Comments, stats[i].Comments)
+		}
+	}
+}
+
+// writeInterface writes an Interface Description Block with a given
+// timestamp resolution and offset, which the writer does not support.
+func writeInterface(t *testing.T, w *Writer, resol uint8, offset int64) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(layers.LinkTypeEthernet))
+	binary.LittleEndian.PutUint32(body[4:8], 65535)
+
+	opts := appendOption(nil, optIFTSResol, []byte{resol})
+	if offset != 0 {
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, uint64(offset))
+		opts = appendOption(opts, optIFTSOffset, value)
+	}
+
+	if err := w.writeBlock(blockTypeInterfaceDescription, body, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTicks writes an Enhanced Packet Block with a raw timestamp.
+func writeTicks(t *testing.T, w *Writer, ifIndex int, ticks uint64) {
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(ifIndex))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ticks>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ticks))
+
+	if err := w.writeBlock(blockTypeEnhancedPacket, body, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimestampResolution(t *testing.T) {
+	tests := []struct {
+		resol  uint8
+		offset int64
+		ticks  uint64
+		want   time.Time
+	}{
+		{6, 0, 1500000000123456, time.Unix(1500000000, 123456000)},
+		{3, 0, 1500000000123, time.Unix(1500000000, 123000000)},
+		{0, 0, 1500000000, time.Unix(1500000000, 0)},
+		{6, 100, 1500000000000001, time.Unix(1500000100, 1000)},
+		{0x80 | 10, 0, 1500000000<<10 | 512, time.Unix(1500000000, 500000000)},
+		{0x80 | 30, 0, 3<<30 | 1, time.Unix(3, 0)},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeInterface(t, w, test.resol, test.offset)
+		writeTicks(t, w, 0, test.ticks)
+
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("resolution %#x: %v", test.resol, err)
+		}
+		if r.Interfaces()[0].TimestampResolution != test.resol {
+			t.Errorf("resolution %#x: read resolution %#x", test.resol, r.Interfaces()[0].TimestampResolution)
+		}
+		if !p.CaptureInfo.Timestamp.Equal(test.want) {
+			t.Errorf("resolution %#x: timestamp %v, want %v", test.resol, p.CaptureInfo.Timestamp, test.want)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	valid := func() (*bytes.Buffer, *Writer) {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.AddInterface(Interface{LinkType: layers.LinkTypeEthernet, SnapLen: 65535}); err != nil {
+			t.Fatal(err)
+		}
+		return &buf, w
+	}
+
+	// block returns a raw block with the given lengths
+	block := func(blockType, totalLen, trailingLen uint32, body []byte) []byte {
+		b := make([]byte, 8, 12+len(body))
+		binary.LittleEndian.PutUint32(b[0:4], blockType)
+		binary.LittleEndian.PutUint32(b[4:8], totalLen)
+		b = append(b, body...)
+		var trailer [4]byte
+		binary.LittleEndian.PutUint32(trailer[:], trailingLen)
+		return append(b, trailer[:]...)
+	}
+
+	tests := []struct {
+		name  string
+		write func(buf *bytes.Buffer, w *Writer)
+		want  error
+	}{
+		{"total length too short", func(buf *bytes.Buffer, w *Writer) {
+			buf.Write(block(blockTypeEnhancedPacket, 8, 8, nil))
+		}, ErrBadBlock},
+		{"total length not aligned", func(buf *bytes.Buffer, w *Writer) {
+			buf.Write(block(blockTypeEnhancedPacket, 34, 34, make([]byte, 22)))
+		}, ErrBadBlock},
+		{"trailing length mismatch", func(buf *bytes.Buffer, w *Writer) {
+			buf.Write(block(blockTypeEnhancedPacket, 32, 36, make([]byte, 20)))
+		}, ErrBadBlock},
+		{"total length beyond the file", func(buf *bytes.Buffer, w *Writer) {
+			buf.Write(block(blockTypeEnhancedPacket, 64, 64, make([]byte, 20)))
+		}, io.ErrUnexpectedEOF},
+		{"capture length beyond the block", func(buf *bytes.Buffer, w *Writer) {
+			body := make([]byte, 20)
+			binary.LittleEndian.PutUint32(body[12:16], 100)
+			buf.Write(block(blockTypeEnhancedPacket, 32, 32, body))
+		}, ErrBadBlock},
+		{"packet body too short", func(buf *bytes.Buffer, w *Writer) {
+			buf.Write(block(blockTypeEnhancedPacket, 20, 20, make([]byte, 8)))
+		}, ErrBadBlock},
+		{"option beyond the block", func(buf *bytes.Buffer, w *Writer) {
+			body := make([]byte, 24)
+			binary.LittleEndian.PutUint16(body[20:22], optComment)
+			binary.LittleEndian.PutUint16(body[22:24], 16)
+			buf.Write(block(blockTypeEnhancedPacket, 36, 36, body))
+		}, ErrBadBlock},
+		{"unknown packet interface", func(buf *bytes.Buffer, w *Writer) {
+			if err := w.WritePacket(0, gopacket.CaptureInfo{}, nil); err != nil {
+				t.Fatal(err)
+			}
+			writeTicks(t, w, 5, 0)
+		}, ErrUnknownInterface},
+		{"unknown statistics interface", func(buf *bytes.Buffer, w *Writer) {
+			body := make([]byte, 12)
+			binary.LittleEndian.PutUint32(body[0:4], 1)
+			buf.Write(block(blockTypeInterfaceStatistics, 24, 24, body))
+		}, ErrUnknownInterface},
+		{"interface body too short", func(buf *bytes.Buffer, w *Writer) {
+			buf.Write(block(blockTypeInterfaceDescription, 16, 16, make([]byte, 4)))
+		}, ErrBadBlock},
+	}
+
+	for _, test := range tests {
+		buf, w := valid()
+		test.write(buf, w)
+
+		r, err := NewReader(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		for {
+			_, err = r.ReadPacket()
+			if err != nil {
+				break
+			}
+		}
+		if err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if err := (&Writer{}).WriteInterfaceStatistics(0, InterfaceStatistics{}); err != ErrUnknownInterface {
+		t.Errorf("statistics of an unknown interface written: %v", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("not a pcapng file"))); err != ErrNotPCAPNG {
+		t.Errorf("got %v for a non-pcapng file, want %v", err, ErrNotPCAPNG)
+	}
+}
@@ -0,0 +1,404 @@
+package pcapng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Reader reads packets from a pcapng file. Every section of the file is
+// read in turn; the interfaces of a section replace those of the previous one.
+type Reader struct {
+	r          *bufio.Reader
+	order      binary.ByteOrder
+	interfaces []Interface
+	buf        []byte
+}
+
+// NewReader returns a reader for the pcapng data in r, reading the first
+// section header block.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+
+	blockType, body, err := reader.readBlock()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrNotPCAPNG
+	}
+	if err != nil {
+		return nil, err
+	}
+	if blockType != blockTypeSectionHeader || len(body) < 16 || reader.order.Uint16(body[4:6]) != 1 {
+		return nil, ErrNotPCAPNG
+	}
+
+	return reader, nil
+}
+
+// Interfaces returns the interfaces described so far in the current section.
+func (r *Reader) Interfaces() []Interface {
+	return r.interfaces
+}
+
+// readBlock reads the next block and returns its type and body. A section
+// header block sets the byte order used for it and the following blocks.
+func (r *Reader) readBlock() (uint32, []byte, error) {
+	var hdr [12]byte
+
+	if _, err := io.ReadFull(r.r, hdr[:8]); err != nil {
+		return 0, nil, err
+	}
+
+	// The byte order of a section header block is found from its magic,
+	// which has the same value in either order for the block type.
+	if binary.LittleEndian.Uint32(hdr[0:4]) == blockTypeSectionHeader {
+		if _, err := io.ReadFull(r.r, hdr[8:12]); err != nil {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		switch {
+		case binary.LittleEndian.Uint32(hdr[8:12]) == byteOrderMagic:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(hdr[8:12]) == byteOrderMagic:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, ErrNotPCAPNG
+		}
+		r.interfaces = nil
+	} else if r.order == nil {
+		return 0, nil, ErrNotPCAPNG
+	}
+
+	blockType := r.order.Uint32(hdr[0:4])
+	totalLen := r.order.Uint32(hdr[4:8])
+	if totalLen < 12 || totalLen%4 != 0 || totalLen > maxBlockLen {
+		return 0, nil, ErrBadBlock
+	}
+
+	// Read the rest of the block, including the trailing length
+	bodyLen := int(totalLen) - 8
+	if cap(r.buf) < bodyLen {
+		r.buf = make([]byte, bodyLen)
+	}
+	block := r.buf[:bodyLen]
+
+	read := 0
+	if blockType == blockTypeSectionHeader {
+		copy(block, hdr[8:12])
+		read = 4
+	}
+	if _, err := io.ReadFull(r.r, block[read:]); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	if r.order.Uint32(block[bodyLen-4:]) != totalLen {
+		return 0, nil, ErrBadBlock
+	}
+
+	return blockType, block[:bodyLen-4], nil
+}
+
+// readOptions calls fn for each option in an options list.
+func (r *Reader) readOptions(b []byte, fn func(code uint16, value []byte)) error {
+	for len(b) >= 4 {
+		code := r.order.Uint16(b[0:2])
+		length := int(r.order.Uint16(b[2:4]))
+		if code == optEndOfOpt {
+			return nil
+		}
+
+		padded := (length + 3) &^ 3
+		if 4+padded > len(b) {
+			return ErrBadBlock
+		}
+		fn(code, b[4:4+length])
+		b = b[4+padded:]
+	}
+
+	return nil
+}
+
+// readInterface parses an Interface Description Block.
+func (r *Reader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return ErrBadBlock
+	}
+
+	iface := Interface{
+		LinkType:            layers.LinkType(r.order.Uint16(body[0:2])),
+		SnapLen:             r.order.Uint32(body[4:8]),
+		TimestampResolution: defaultTSResol,
+	}
+
+	err := r.readOptions(body[8:], func(code uint16, value []byte) {
+		switch code {
+		case optIFName:
+			iface.Name = optionString(value)
+		case optIFDescription:
+			iface.Description = optionString(value)
+		case optIFTSResol:
+			if len(value) == 1 {
+				iface.TimestampResolution = value[0]
+			}
+		case optIFTSOffset:
+			if len(value) == 8 {
+				iface.TimestampOffset = int64(r.order.Uint64(value))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Reject resolutions that do not fit in 64 bits
+	if resol := iface.TimestampResolution; (resol&0x80 == 0 && resol > 19) || (resol&0x80 != 0 && resol&0x7f > 63) {
+		return ErrBadBlock
+	}
+
+	r.interfaces = append(r.interfaces, iface)
+
+	return nil
+}
+
+// timestamp converts the high and low timestamp words of a block.
+func (r *Reader) timestamp(ifIndex int, b []byte) gopacket.CaptureInfo {
+	iface := r.interfaces[ifIndex]
+	ticks := uint64(r.order.Uint32(b[0:4]))<<32 | uint64(r.order.Uint32(b[4:8]))
+
+	return gopacket.CaptureInfo{
+		Timestamp: ticksToTime(ticks, iface.TimestampResolution, iface.TimestampOffset),
+	}
+}
+
+// readStatistics parses an Interface Statistics Block.
+func (r *Reader) readStatistics(body []byte) error {
+	if len(body) < 12 {
+		return ErrBadBlock
+	}
+
+	ifIndex := int(r.order.Uint32(body[0:4]))
+	if ifIndex >= len(r.interfaces) {
+		return ErrUnknownInterface
+	}
+
+	iface := r.interfaces[ifIndex]
+	stats := &InterfaceStatistics{
+		Timestamp: r.timestamp(ifIndex, body[4:12]).Timestamp,
+	}
+
+	err := r.readOptions(body[12:], func(code uint16, value []byte) {
+		var counter *uint64
+		if len(value) == 8 {
+			v := r.order.Uint64(value)
+			counter = &v
+		}
+
+		switch code {
+		case optComment:
+			stats.Comments = append(stats.Comments, optionString(value))
+		case optISBStartTime, optISBEndTime:
+			if len(value) == 8 {
+				ticks := uint64(r.order.Uint32(value[0:4]))<<32 | uint64(r.order.Uint32(value[4:8]))
+				t := ticksToTime(ticks, iface.TimestampResolution, iface.TimestampOffset)
+				if code == optISBStartTime {
+					stats.StartTime = &t
+				} else {
+					stats.EndTime = &t
+				}
+			}
+		case optISBIFRecv:
+			stats.Received = counter
+		case optISBIFDrop:
+			stats.Dropped = counter
+		case optISBFilterAccept:
+			stats.FilterAccepted = counter
+		case optISBOSDrop:
+			stats.OSDropped = counter
+		case optISBUsrDeliv:
+			stats.Delivered = counter
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	r.interfaces[ifIndex].Statistics = stats
+
+	return nil
+}
+
+// readPacketData copies captured packet data and validates its length.
+func readPacketData(b []byte, capLen uint32) ([]byte, []byte, error) {
+	padded := (int(capLen) + 3) &^ 3
+	if int(capLen) > len(b) || padded > len(b) {
+		return nil, nil, ErrBadBlock
+	}
+
+	data := make([]byte, capLen)
+	copy(data, b[:capLen])
+
+	return data, b[padded:], nil
+}
+
+// ReadPacket returns the next packet in the file, or io.EOF at the end of
+// the file. Interface description and statistics blocks are processed as
+// they are reached and other blocks are skipped.
+func (r *Reader) ReadPacket() (*Packet, error) {
+	for {
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case blockTypeInterfaceDescription:
+			if err := r.readInterface(body); err != nil {
+				return nil, err
+			}
+		case blockTypeInterfaceStatistics:
+			if err := r.readStatistics(body); err != nil {
+				return nil, err
+			}
+		case blockTypeEnhancedPacket:
+			return r.readEnhancedPacket(body)
+		case blockTypePacket:
+			return r.readObsoletePacket(body)
+		case blockTypeSimplePacket:
+			return r.readSimplePacket(body)
+		}
+	}
+}
+
+// readEnhancedPacket parses an Enhanced Packet Block.
+func (r *Reader) readEnhancedPacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, ErrBadBlock
+	}
+
+	ifIndex := int(r.order.Uint32(body[0:4]))
+	if ifIndex >= len(r.interfaces) {
+		return nil, ErrUnknownInterface
+	}
+
+	packet := &Packet{
+		CaptureInfo:    r.timestamp(ifIndex, body[4:12]),
+		InterfaceIndex: ifIndex,
+	}
+	capLen := r.order.Uint32(body[12:16])
+	packet.CaptureInfo.CaptureLength = int(capLen)
+	packet.CaptureInfo.Length = int(r.order.Uint32(body[16:20]))
+
+	data, options, err := readPacketData(body[20:], capLen)
+	if err != nil {
+		return nil, err
+	}
+	packet.Data = data
+
+	err = r.readOptions(options, func(code uint16, value []byte) {
+		switch code {
+		case optComment:
+			packet.Comments = append(packet.Comments, optionString(value))
+		case optEPBDropCount:
+			if len(value) == 8 {
+				v := r.order.Uint64(value)
+				packet.DropCount = &v
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// readObsoletePacket parses the obsolete Packet Block.
+func (r *Reader) readObsoletePacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, ErrBadBlock
+	}
+
+	ifIndex := int(r.order.Uint16(body[0:2]))
+	if ifIndex >= len(r.interfaces) {
+		return nil, ErrUnknownInterface
+	}
+
+	drops := uint64(r.order.Uint16(body[2:4]))
+	packet := &Packet{
+		CaptureInfo:    r.timestamp(ifIndex, body[4:12]),
+		InterfaceIndex: ifIndex,
+	}
+	if drops != 0xffff {
+		packet.DropCount = &drops
+	}
+	capLen := r.order.Uint32(body[12:16])
+	packet.CaptureInfo.CaptureLength = int(capLen)
+	packet.CaptureInfo.Length = int(r.order.Uint32(body[16:20]))
+
+	data, options, err := readPacketData(body[20:], capLen)
+	if err != nil {
+		return nil, err
+	}
+	packet.Data = data
+
+	err = r.readOptions(options, func(code uint16, value []byte) {
+		if code == optComment {
+			packet.Comments = append(packet.Comments, optionString(value))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// readSimplePacket parses a Simple Packet Block, which always belongs to
+// the first interface and carries no timestamp.
+func (r *Reader) readSimplePacket(body []byte) (*Packet, error) {
+	if len(body) < 4 {
+		return nil, ErrBadBlock
+	}
+	if len(r.interfaces) == 0 {
+		return nil, ErrUnknownInterface
+	}
+
+	length := r.order.Uint32(body[0:4])
+	capLen := length
+	if snapLen := r.interfaces[0].SnapLen; snapLen != 0 && capLen > snapLen {
+		capLen = snapLen
+	}
+
+	data, _, err := readPacketData(body[4:], capLen)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := &Packet{
+		Data: data,
+		CaptureInfo: gopacket.CaptureInfo{
+			CaptureLength: int(capLen),
+			Length:        int(length),
+		},
+	}
+
+	return packet, nil
+}
+
+// ReadPacketData returns the next packet in the file. It implements
+// gopacket.PacketDataSource for files with a single link type.
+func (r *Reader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	packet, err := r.ReadPacket()
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+
+	return packet.Data, packet.CaptureInfo, nil
+}
+
+// optionString converts a UTF-8 option value, which may be NUL terminated.
+func optionString(value []byte) string {
+	return strings.TrimRight(string(value), "\x00")
+}
@@ -0,0 +1,195 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Timestamp resolution of the interfaces written (nanoseconds)
+const writerTSResol uint8 = 9
+
+// Writer writes packets to a pcapng file. It writes a single little-endian
+// section with nanosecond timestamps for every interface.
+type Writer struct {
+	w          io.Writer
+	interfaces []Interface
+	buf        []byte
+}
+
+// NewWriter writes a section header block to w and returns a writer for it.
+// The application name is recorded in the section header if not empty.
+func NewWriter(w io.Writer, application string) (*Writer, error) {
+	writer := &Writer{w: w}
+
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint16(body[6:8], 0)
+	// Section length is not known in advance
+	binary.LittleEndian.PutUint64(body[8:16], 0xFFFFFFFFFFFFFFFF)
+
+	var opts []byte
+	if application != "" {
+		opts = appendOption(opts, optSHBUserAppl, []byte(application))
+	}
+
+	if err := writer.writeBlock(blockTypeSectionHeader, body, opts); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// AddInterface writes an Interface Description Block and returns the
+// index to use for packets captured on the interface. The timestamp
+// resolution and offset of iface are ignored.
+func (w *Writer) AddInterface(iface Interface) (int, error) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(iface.LinkType))
+	binary.LittleEndian.PutUint32(body[4:8], iface.SnapLen)
+
+	var opts []byte
+	if iface.Name != "" {
+		opts = appendOption(opts, optIFName, []byte(iface.Name))
+	}
+	if iface.Description != "" {
+		opts = appendOption(opts, optIFDescription, []byte(iface.Description))
+	}
+	opts = appendOption(opts, optIFTSResol, []byte{writerTSResol})
+
+	if err := w.writeBlock(blockTypeInterfaceDescription, body, opts); err != nil {
+		return 0, err
+	}
+
+	iface.TimestampResolution = writerTSResol
+	iface.TimestampOffset = 0
+	iface.Statistics = nil
+	w.interfaces = append(w.interfaces, iface)
+
+	return len(w.interfaces) - 1, nil
+}
+
+// Interfaces returns the interfaces added to the writer.
+func (w *Writer) Interfaces() []Interface {
+	return w.interfaces
+}
+
+// WritePacket writes an Enhanced Packet Block for a packet captured on an
+// interface, with optional comments.
+func (w *Writer) WritePacket(ifIndex int, ci gopacket.CaptureInfo, data []byte, comments ...string) error {
+	if ifIndex < 0 || ifIndex >= len(w.interfaces) {
+		return ErrUnknownInterface
+	}
+
+	padded := (len(data) + 3) &^ 3
+	body := make([]byte, 20+padded)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(ifIndex))
+	putTimestamp(body[4:12], ci.Timestamp)
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(ci.Length))
+	copy(body[20:], data)
+
+	var opts []byte
+	for _, comment := range comments {
+		opts = appendOption(opts, optComment, []byte(comment))
+	}
+
+	return w.writeBlock(blockTypeEnhancedPacket, body, opts)
+}
+
+// WriteInterfaceStatistics writes an Interface Statistics Block for an
+// interface. Nil counters are left out.
+func (w *Writer) WriteInterfaceStatistics(ifIndex int, stats InterfaceStatistics) error {
+	if ifIndex < 0 || ifIndex >= len(w.interfaces) {
+		return ErrUnknownInterface
+	}
+
+	body := make([]byte, 12)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(ifIndex))
+	putTimestamp(body[4:12], stats.Timestamp)
+
+	var opts []byte
+	for _, comment := range stats.Comments {
+		opts = appendOption(opts, optComment, []byte(comment))
+	}
+	if stats.StartTime != nil {
+		opts = appendOption(opts, optISBStartTime, timestampValue(*stats.StartTime))
+	}
+	if stats.EndTime != nil {
+		opts = appendOption(opts, optISBEndTime, timestampValue(*stats.EndTime))
+	}
+
+	counters := []struct {
+		code  uint16
+		value *uint64
+	}{
+		{optISBIFRecv, stats.Received},
+		{optISBIFDrop, stats.Dropped},
+		{optISBFilterAccept, stats.FilterAccepted},
+		{optISBOSDrop, stats.OSDropped},
+		{optISBUsrDeliv, stats.Delivered},
+	}
+	for _, counter := range counters {
+		if counter.value != nil {
+			value := make([]byte, 8)
+			binary.LittleEndian.PutUint64(value, *counter.value)
+			opts = appendOption(opts, counter.code, value)
+		}
+	}
+
+	return w.writeBlock(blockTypeInterfaceStatistics, body, opts)
+}
+
+// writeBlock writes a block with its body and options.
+func (w *Writer) writeBlock(blockType uint32, body, opts []byte) error {
+	if len(opts) > 0 {
+		opts = appendOption(opts, optEndOfOpt, nil)
+	}
+
+	totalLen := 12 + len(body) + len(opts)
+	if cap(w.buf) < totalLen {
+		w.buf = make([]byte, totalLen)
+	}
+	b := w.buf[:totalLen]
+
+	binary.LittleEndian.PutUint32(b[0:4], blockType)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(totalLen))
+	copy(b[8:], body)
+	copy(b[8+len(body):], opts)
+	binary.LittleEndian.PutUint32(b[totalLen-4:], uint32(totalLen))
+
+	_, err := w.w.Write(b)
+	return err
+}
+
+// appendOption appends an option padded to 32 bits.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], code)
+	binary.LittleEndian.PutUint16(hdr[2:4], uint16(len(value)))
+
+	b = append(b, hdr[:]...)
+	b = append(b, value...)
+	for i := len(value); i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+// putTimestamp writes the high and low words of a nanosecond timestamp.
+func putTimestamp(b []byte, t time.Time) {
+	ticks := uint64(t.UnixNano())
+	binary.LittleEndian.PutUint32(b[0:4], uint32(ticks>>32))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(ticks))
+}
+
+// timestampValue returns a timestamp option value.
+func timestampValue(t time.Time) []byte {
+	value := make([]byte, 8)
+	putTimestamp(value, t)
+	return value
+}
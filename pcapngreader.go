@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kbrebanov/nose-bleed/pcapng"
+
+	"github.com/google/gopacket"
+)
+
+// pcapngMagic is the block type of the pcapng section header block
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// interfaceStatisticsRecord is the record sent for each pcapng Interface
+// Statistics Block
+type interfaceStatisticsRecord struct {
+	Type           string     `json:"type"`
+	File           string     `json:"file"`
+	InterfaceIndex int        `json:"interface_index"`
+	Interface      string     `json:"interface"`
+	Timestamp      string     `json:"timestamp"`
+	StartTime      *time.Time `json:"start_time,omitempty"`
+	EndTime        *time.Time `json:"end_time,omitempty"`
+	Received       *uint64    `json:"received,omitempty"`
+	Dropped        *uint64    `json:"dropped,omitempty"`
+	FilterAccepted *uint64    `json:"filter_accepted,omitempty"`
+	OSDropped      *uint64    `json:"os_dropped,omitempty"`
+	Delivered      *uint64    `json:"delivered,omitempty"`
+	Comments       []string   `json:"comments,omitempty"`
+}
+
+// isPCAPNG reports whether a capture file is in pcapng format.
+func isPCAPNG(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(pcapngMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		// Too short to be pcapng, leave it to libpcap to report
+		return false, nil
+	}
+
+	return bytes.Equal(magic, pcapngMagic), nil
+}
+
+// readPCAPNG reads the packets of a pcapng file natively, keeping the
+// interface, comments and drop counts of each packet, and sends a record
+// for each interface with statistics at the end of the file. Reading stops
+// early when a limit is reached or stop is closed.
+func readPCAPNG(file string, out *output, lim *limiter, stop <-chan struct{}) (captureSummary, error) {
+	var summary captureSummary
+
+	f, err := os.Open(file)
+	if err != nil {
+		return summary, err
+	}
+	defer f.Close()
+
+	r, err := pcapng.NewReader(f)
+	if err != nil {
+		return summary, err
+	}
+
+	for !stopped(stop) && !lim.done() {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sendInterfaceStatistics(file, r.Interfaces(), out)
+			return summary, err
+		}
+
+		iface := r.Interfaces()[p.InterfaceIndex]
+
+		packet := gopacket.NewPacket(p.Data, iface.LinkType, gopacket.Default)
+		packet.Metadata().CaptureInfo = p.CaptureInfo
+		if !lim.allow(packet) {
+			break
+		}
+
+		info := map[string]interface{}{
+			"interface_index": p.InterfaceIndex,
+			"link_type":       iface.LinkType.String(),
+			"snaplen":         iface.SnapLen,
+		}
+		if len(p.Comments) > 0 {
+			info["comments"] = p.Comments
+		}
+		if p.DropCount != nil {
+			info["drop_count"] = *p.DropCount
+		}
+
+		extra := map[string]interface{}{
+			"interface": iface.Name,
+			"pcapng":    info,
+		}
+		handlePacket(packet, extra, out, &summary)
+	}
+
+	sendInterfaceStatistics(file, r.Interfaces(), out)
+
+	return summary, nil
+}
+
+// sendInterfaceStatistics sends a record for each interface that has
+// statistics.
+func sendInterfaceStatistics(file string, interfaces []pcapng.Interface, out *output) {
+	for i, iface := range interfaces {
+		stats := iface.Statistics
+		if stats == nil {
+			continue
+		}
+
+		record := interfaceStatisticsRecord{
+			Type:           recordInterfaceStatistics,
+			File:           file,
+			InterfaceIndex: i,
+			Interface:      iface.Name,
+			Timestamp:      stats.Timestamp.String(),
+			StartTime:      stats.StartTime,
+			EndTime:        stats.EndTime,
+			Received:       stats.Received,
+			Dropped:        stats.Dropped,
+			FilterAccepted: stats.FilterAccepted,
+			OSDropped:      stats.OSDropped,
+			Delivered:      stats.Delivered,
+			Comments:       stats.Comments,
+		}
+
+		out.send(record, recordInfo{
+			Type:      recordInterfaceStatistics,
+			Timestamp: stats.Timestamp,
+			Interface: iface.Name,
+		})
+	}
+}
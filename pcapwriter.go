@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kbrebanov/nose-bleed/pcapng"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Capture file formats
+const (
+	formatPCAP   = "pcap"
+	formatPCAPNG = "pcapng"
+)
+
+// pcapWriteOptions holds the options for writing raw packets to pcap files
+type pcapWriteOptions struct {
+	Dir      string
+	Format   string
+	MaxSize  int64
+	MaxAge   time.Duration
+	MaxFiles int
+}
+
+// countingWriter counts the bytes written to an io.Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// pcapWriter writes raw packets to pcap or pcapng files in a directory,
+// rotating them by size and age and retaining at most a maximum number of files.
+// A pcapng writer can hold packets from several interfaces, a pcap writer
+// from a single one.
+type pcapWriter struct {
+	dir        string
+	format     string
+	label      string
+	interfaces []pcapng.Interface
+	maxSize    int64
+	maxAge     time.Duration
+	maxFiles   int
+	// Counters of the interface with the given index, written to pcapng
+	// files when they are closed, and the time they started from
+	stats   func(ifIndex int) (captureStats, error)
+	started time.Time
+
+	file   *os.File
+	buf    *bufio.Writer
+	count  *countingWriter
+	w      *pcapgo.Writer
+	ngw    *pcapng.Writer
+	name   string
+	opened time.Time
+	index  int
+	files  []string
+}
+
+// newPCAPWriter creates a pcap writer for packets captured on the given
+// interfaces. The label names the files, typically after the devices.
+// A MaxSize, MaxAge or MaxFiles of zero disables the respective limit.
+// The age of a file is only checked when a packet is written, so a file is
+// not rotated while no packets are captured.
+func newPCAPWriter(opts pcapWriteOptions, label string, interfaces []pcapng.Interface) (*pcapWriter, error) {
+	if opts.Format == "" {
+		opts.Format = formatPCAP
+	}
+	if opts.Format != formatPCAP && opts.Format != formatPCAPNG {
+		return nil, fmt.Errorf("unknown capture file format %q", opts.Format)
+	}
+	if opts.Format == formatPCAP && len(interfaces) != 1 {
+		return nil, fmt.Errorf("pcap files hold a single interface, got %d", len(interfaces))
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	pw := &pcapWriter{
+		dir:        opts.Dir,
+		format:     opts.Format,
+		label:      label,
+		interfaces: interfaces,
+		maxSize:    opts.MaxSize,
+		maxAge:     opts.MaxAge,
+		maxFiles:   opts.MaxFiles,
+		started:    time.Now(),
+	}
+
+	return pw, nil
+}
+
+// fileName returns the name of a pcap file started at the given time.
+func (pw *pcapWriter) fileName(start time.Time) string {
+	label := strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(pw.label)
+
+	return filepath.Join(pw.dir, fmt.Sprintf("nose-bleed-%s-%s.%s",
+		label, start.UTC().Format("20060102T150405.000000000Z"), pw.format))
+}
+
+// open starts a new pcap file.
+func (pw *pcapWriter) open(start time.Time) error {
+	name := pw.fileName(start)
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	pw.file = file
+	pw.buf = bufio.NewWriter(file)
+	pw.count = &countingWriter{w: pw.buf}
+	pw.name = name
+	pw.opened = start
+	pw.index = 0
+
+	if err := pw.writeHeader(); err != nil {
+		pw.closeFile()
+		return err
+	}
+
+	pw.files = append(pw.files, name)
+
+	// Remove the oldest files beyond the retention limit
+	for pw.maxFiles > 0 && len(pw.files) > pw.maxFiles {
+		if err := os.Remove(pw.files[0]); err != nil {
+			log.Println("Failed to remove old pcap file:", err)
+		}
+		pw.files = pw.files[1:]
+	}
+
+	return nil
+}
+
+// writeHeader writes the file header, and for pcapng the interface descriptions.
+func (pw *pcapWriter) writeHeader() error {
+	if pw.format == formatPCAPNG {
+		var err error
+		pw.ngw, err = pcapng.NewWriter(pw.count, "nose-bleed "+version)
+		if err != nil {
+			return err
+		}
+		for _, iface := range pw.interfaces {
+			if _, err := pw.ngw.AddInterface(iface); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pw.w = pcapgo.NewWriter(pw.count)
+	return pw.w.WriteFileHeader(pw.interfaces[0].SnapLen, pw.interfaces[0].LinkType)
+}
+
+// writeStatistics writes an Interface Statistics Block with the capture
+// counters of each interface of a pcapng file.
+func (pw *pcapWriter) writeStatistics() error {
+	if pw.ngw == nil || pw.stats == nil {
+		return nil
+	}
+
+	now := time.Now()
+	for i := range pw.ngw.Interfaces() {
+		stats, err := pw.stats(i)
+		if err != nil {
+			log.Println("Failed to get capture statistics for", pw.interfaces[i].Name+":", err)
+			continue
+		}
+
+		err = pw.ngw.WriteInterfaceStatistics(i, pcapng.InterfaceStatistics{
+			Timestamp: now,
+			StartTime: &pw.started,
+			EndTime:   &now,
+			Received:  &stats.Received,
+			Dropped:   &stats.IfDropped,
+			OSDropped: &stats.Dropped,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeFile writes the interface statistics of a pcapng file, then flushes
+// and closes the current pcap file.
+func (pw *pcapWriter) closeFile() error {
+	if pw.file == nil {
+		return nil
+	}
+
+	err := pw.writeStatistics()
+	if ferr := pw.buf.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := pw.file.Close(); err == nil {
+		err = cerr
+	}
+
+	pw.file = nil
+	pw.buf = nil
+	pw.count = nil
+	pw.w = nil
+	pw.ngw = nil
+
+	return err
+}
+
+// rotate reports whether the next packet should start a new file.
+func (pw *pcapWriter) rotate(now time.Time) bool {
+	if pw.file == nil {
+		return true
+	}
+	if pw.index == 0 {
+		return false
+	}
+	if pw.maxSize > 0 && pw.count.n >= pw.maxSize {
+		return true
+	}
+	if pw.maxAge > 0 && now.Sub(pw.opened) >= pw.maxAge {
+		return true
+	}
+
+	return false
+}
+
+// write writes a packet captured on the interface with the given index to
+// the current pcap file, rotating it if needed, and returns the name of the
+// file and the 1-based index of the packet in it.
+func (pw *pcapWriter) write(packet gopacket.Packet, ifIndex int) (string, int, error) {
+	ci := packet.Metadata().CaptureInfo
+	data := packet.Data()
+	now := time.Now()
+
+	if pw.rotate(now) {
+		if err := pw.closeFile(); err != nil {
+			log.Println("Failed to close pcap file:", err)
+		}
+		if err := pw.open(now); err != nil {
+			return "", 0, err
+		}
+	}
+
+	var err error
+	if pw.ngw != nil {
+		err = pw.ngw.WritePacket(ifIndex, ci, data)
+	} else {
+		err = pw.w.WritePacket(ci, data)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	pw.index++
+
+	return pw.name, pw.index, nil
+}
+
+// close flushes and closes the current pcap file.
+func (pw *pcapWriter) close() error {
+	return pw.closeFile()
+}
@@ -0,0 +1,784 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Buffer drop policies
+const (
+	dropOldest = "oldest"
+	dropNewest = "newest"
+)
+
+// Queue overflow policies
+const (
+	overflowDropHead         = "drop-head"
+	overflowRejectPublish    = "reject-publish"
+	overflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+// Orders in which the RabbitMQ nodes are tried
+const (
+	hostOrderOrdered = "ordered"
+	hostOrderRandom  = "random"
+)
+
+// Default ports of the AMQP URI schemes
+var amqpPorts = map[string]int{
+	"amqp":  5672,
+	"amqps": 5671,
+}
+
+// Defaults of the RabbitMQ reconnect and buffer settings
+const (
+	defaultReconnectInitialInterval = 500 * time.Millisecond
+	defaultReconnectMaxInterval     = 30 * time.Second
+	defaultBufferSize               = 10000
+	defaultFlushTimeout             = 5 * time.Second
+	defaultMaxInFlight              = 256
+	defaultMaxRetries               = 3
+)
+
+// closedChan is always ready to receive from
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// message is a queued message
+type message struct {
+	key string
+	msg amqp.Publishing
+	// attempts is the number of times the message was published in
+	// confirm mode and returned whether it was returned as unroutable
+	attempts int
+	returned bool
+}
+
+// publisher publishes messages to a RabbitMQ exchange from its own
+// goroutine. Messages are buffered in a bounded queue, which holds them
+// while the connection is down. Lost connections are reopened with
+// exponential backoff.
+type publisher struct {
+	// Number of failed publishes, of messages dropped from the buffer and
+	// of messages nacked or returned on every attempt, updated atomically
+	failures      uint64
+	dropped       uint64
+	unconfirmed   uint64
+	returnedCount uint64
+
+	settings  RabbitMQSettings
+	tlsConfig *tls.Config
+
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	bufferSize      int
+	dropPolicy      string
+	flushTimeout    time.Duration
+	confirm         bool
+	maxInFlight     int
+	maxRetries      int
+	rnd             *rand.Rand
+
+	mu       sync.Mutex // guards below
+	queue    []message
+	dropping bool
+
+	// Messages waiting for their confirmation, in publish order
+	inFlight []*message
+
+	// wake is signalled when a message is queued
+	wake chan struct{}
+	// closing is closed to publish the queued messages and stop, abort to
+	// stop at once
+	closing chan struct{}
+	abort   chan struct{}
+	done    chan struct{}
+
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+// newPublisher connects to RabbitMQ and declares the exchange, then starts
+// publishing in the background.
+func newPublisher(settings RabbitMQSettings) (*publisher, error) {
+	p := &publisher{
+		settings:        settings,
+		initialInterval: defaultReconnectInitialInterval,
+		maxInterval:     defaultReconnectMaxInterval,
+		bufferSize:      defaultBufferSize,
+		dropPolicy:      dropOldest,
+		flushTimeout:    defaultFlushTimeout,
+		confirm:         settings.Publish.Confirm,
+		maxInFlight:     defaultMaxInFlight,
+		maxRetries:      defaultMaxRetries,
+		rnd:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:            make(chan struct{}, 1),
+		closing:         make(chan struct{}),
+		abort:           make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	if ms := settings.Reconnect.InitialIntervalMS; ms > 0 {
+		p.initialInterval = time.Duration(ms) * time.Millisecond
+	}
+	if ms := settings.Reconnect.MaxIntervalMS; ms > 0 {
+		p.maxInterval = time.Duration(ms) * time.Millisecond
+	}
+	if p.maxInterval < p.initialInterval {
+		p.maxInterval = p.initialInterval
+	}
+	if settings.Buffer.Size > 0 {
+		p.bufferSize = settings.Buffer.Size
+	}
+	if ms := settings.Buffer.FlushTimeoutMS; ms > 0 {
+		p.flushTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if settings.Publish.MaxInFlight > 0 {
+		p.maxInFlight = settings.Publish.MaxInFlight
+	}
+	if settings.Publish.MaxRetries != nil {
+		p.maxRetries = *settings.Publish.MaxRetries
+	}
+
+	if err := checkDropPolicy(settings.Buffer.DropPolicy); err != nil {
+		return nil, err
+	}
+	if settings.Buffer.DropPolicy != "" {
+		p.dropPolicy = settings.Buffer.DropPolicy
+	}
+
+	for i, queue := range settings.Queues {
+		if queue.Name == "" {
+			return nil, fmt.Errorf("queue %d has no name", i)
+		}
+		if err := checkOverflow(queue.Overflow); err != nil {
+			return nil, fmt.Errorf("queue %s: %v", queue.Name, err)
+		}
+	}
+
+	tlsConfig, err := rabbitMQTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	p.tlsConfig = tlsConfig
+
+	// Fail fast if RabbitMQ cannot be reached at all
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+
+	go p.run()
+
+	return p, nil
+}
+
+// endpoint is a RabbitMQ node to connect to
+type endpoint struct {
+	uri string
+	// node is the host and port of the node, safe to log
+	node string
+	tls  bool
+}
+
+// endpoints returns the RabbitMQ nodes to connect to, from the uris, the
+// hosts and the host in this order. User names, passwords and vhosts are
+// escaped.
+func endpoints(settings RabbitMQSettings) ([]endpoint, error) {
+	var eps []endpoint
+
+	for _, s := range settings.URIs {
+		u, err := parseAMQPURI(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.User == nil && settings.User != "" {
+			u.User = url.UserPassword(settings.User, settings.Password)
+		}
+
+		node := u.Host
+		if u.Port() == "" {
+			node = net.JoinHostPort(u.Hostname(), strconv.Itoa(amqpPorts[u.Scheme]))
+		}
+		eps = append(eps, endpoint{uri: u.String(), node: node, tls: u.Scheme == "amqps"})
+	}
+
+	scheme := "amqp"
+	if settings.TLS.Enabled {
+		scheme = "amqps"
+	}
+	port := settings.Port
+	if port == 0 {
+		port = amqpPorts[scheme]
+	}
+
+	hosts := settings.Hosts
+	if settings.Host != "" {
+		hosts = append(hosts[:len(hosts):len(hosts)], settings.Host)
+	}
+	for _, host := range hosts {
+		node := host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			node = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+		}
+
+		u := url.URL{
+			Scheme: scheme,
+			User:   url.UserPassword(settings.User, settings.Password),
+			Host:   node,
+			Path:   "/" + settings.VHost,
+			// Slashes in the vhost are part of its name
+			RawPath: "/" + url.PathEscape(settings.VHost),
+		}
+		eps = append(eps, endpoint{uri: u.String(), node: node, tls: settings.TLS.Enabled})
+	}
+
+	if len(eps) == 0 {
+		return nil, fmt.Errorf("no RabbitMQ host or URI")
+	}
+
+	if err := checkHostOrder(settings.HostOrder); err != nil {
+		return nil, err
+	}
+
+	return eps, nil
+}
+
+// parseAMQPURI parses a RabbitMQ URI with the amqp or amqps scheme.
+func parseAMQPURI(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RabbitMQ URI: %v", err)
+	}
+	if _, ok := amqpPorts[u.Scheme]; !ok {
+		return nil, fmt.Errorf("invalid RabbitMQ URI scheme %q, use amqp or amqps", u.Scheme)
+	}
+	return u, nil
+}
+
+// checkHostOrder returns an error for an unknown host order.
+func checkHostOrder(order string) error {
+	switch order {
+	case "", hostOrderOrdered, hostOrderRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown host order %q, use %s or %s", order, hostOrderOrdered, hostOrderRandom)
+}
+
+// checkDropPolicy returns an error for an unknown buffer drop policy.
+func checkDropPolicy(policy string) error {
+	switch policy {
+	case "", dropOldest, dropNewest:
+		return nil
+	}
+	return fmt.Errorf("unknown drop policy %q, use %s or %s", policy, dropOldest, dropNewest)
+}
+
+// checkOverflow returns an error for an unknown queue overflow policy.
+func checkOverflow(overflow string) error {
+	switch overflow {
+	case "", overflowDropHead, overflowRejectPublish, overflowRejectPublishDLX:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q, use %s, %s or %s", overflow,
+		overflowDropHead, overflowRejectPublish, overflowRejectPublishDLX)
+}
+
+// dial opens a connection to the first RabbitMQ node that accepts it,
+// trying them in order or in random order. tlsConfig is used for the nodes
+// connected to with TLS.
+func dial(settings RabbitMQSettings, tlsConfig *tls.Config, rnd *rand.Rand) (*amqp.Connection, error) {
+	eps, err := endpoints(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.HostOrder == hostOrderRandom {
+		rnd.Shuffle(len(eps), func(i, j int) {
+			eps[i], eps[j] = eps[j], eps[i]
+		})
+	}
+
+	for _, ep := range eps {
+		var conn *amqp.Connection
+		if ep.tls {
+			conn, err = amqp.DialTLS(ep.uri, tlsConfig)
+		} else {
+			conn, err = amqp.Dial(ep.uri)
+		}
+		if err != nil {
+			log.Printf("Failed to connect to RabbitMQ node %s: %v", ep.node, err)
+			continue
+		}
+
+		if cluster, ok := conn.Properties["cluster_name"].(string); ok && cluster != "" {
+			log.Printf("Connected to RabbitMQ node %s of cluster %s", ep.node, cluster)
+		} else {
+			log.Println("Connected to RabbitMQ node", ep.node)
+		}
+		return conn, nil
+	}
+
+	if len(eps) > 1 {
+		return nil, fmt.Errorf("failed to connect to any of %d RabbitMQ nodes: %v", len(eps), err)
+	}
+	return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+}
+
+// connect opens a connection and a channel and declares the exchange.
+func (p *publisher) connect() error {
+	conn, err := dial(p.settings, p.tlsConfig, p.rnd)
+	if err != nil {
+		return err
+	}
+
+	// Create a channel
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+
+	// Declare an exchange
+	err = ch.ExchangeDeclare(
+		p.settings.Exchange.Name,
+		p.settings.Exchange.Type,
+		p.settings.Exchange.Durable,
+		p.settings.Exchange.AutoDelete,
+		p.settings.Exchange.Internal,
+		p.settings.Exchange.NoWait,
+		nil)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to declare an exchange: %v", err)
+	}
+
+	// Declare the queues, so that records are kept until consumed
+	for _, queue := range p.settings.Queues {
+		if err := declareQueue(ch, p.settings.Exchange.Name, queue); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	// Have the broker confirm every publish
+	if p.confirm {
+		if err := ch.Confirm(false); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to put channel in confirm mode: %v", err)
+		}
+	}
+
+	p.conn = conn
+	p.ch = ch
+
+	return nil
+}
+
+// declareQueue declares a queue and binds it to the exchange with each of
+// its binding keys, or with an empty key if it has none.
+func declareQueue(ch *amqp.Channel, exchange string, queue RabbitMQQueueSettings) error {
+	args := amqp.Table{}
+	if queue.MessageTTLMS > 0 {
+		args["x-message-ttl"] = queue.MessageTTLMS
+	}
+	if queue.MaxLength > 0 {
+		args["x-max-length"] = queue.MaxLength
+	}
+	if queue.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = queue.MaxLengthBytes
+	}
+	if queue.Overflow != "" {
+		args["x-overflow"] = queue.Overflow
+	}
+	if queue.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = queue.DeadLetterExchange
+	}
+	if queue.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = queue.DeadLetterRoutingKey
+	}
+
+	_, err := ch.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, false, false, args)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %v", queue.Name, err)
+	}
+
+	keys := queue.BindingKeys
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	for _, key := range keys {
+		if err := ch.QueueBind(queue.Name, key, exchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind queue %s with key %q: %v", queue.Name, key, err)
+		}
+	}
+
+	return nil
+}
+
+// disconnect closes the channel and connection, if any. Errors are only
+// logged if the connection was expected to be open.
+func (p *publisher) disconnect(lost bool) {
+	if p.ch != nil {
+		if err := p.ch.Close(); err != nil && !lost {
+			log.Println("Failed to close RabbitMQ channel:", err)
+		}
+		p.ch = nil
+	}
+	if p.conn != nil {
+		if err := p.conn.Close(); err != nil && !lost {
+			log.Println("Failed to close RabbitMQ connection:", err)
+		}
+		p.conn = nil
+	}
+}
+
+// reconnect connects again, waiting longer after each failure. It returns
+// false if the publisher is aborted first.
+func (p *publisher) reconnect() bool {
+	interval := p.initialInterval
+
+	for attempt := 1; ; attempt++ {
+		// Equal jitter, between half the interval and the interval
+		wait := interval/2 + time.Duration(p.rnd.Int63n(int64(interval/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-p.abort:
+			return false
+		}
+
+		err := p.connect()
+		if err == nil {
+			log.Println("Reconnected to RabbitMQ after", attempt, "attempts")
+			return true
+		}
+		log.Println("Failed to reconnect to RabbitMQ:", err)
+
+		interval *= 2
+		if interval > p.maxInterval {
+			interval = p.maxInterval
+		}
+	}
+}
+
+// run publishes the queued messages, reconnecting whenever the connection
+// or the channel is lost, until the publisher is closed.
+func (p *publisher) run() {
+	defer close(p.done)
+
+	for {
+		err := p.publishQueued()
+		if err == nil {
+			p.disconnect(false)
+			return
+		}
+		log.Println("Lost RabbitMQ connection, reconnecting:", err)
+
+		p.disconnect(true)
+		if !p.reconnect() {
+			return
+		}
+	}
+}
+
+// publishQueued publishes the queued messages on the current channel. It
+// returns nil once the publisher is closed and the queue is empty, or it
+// is aborted, and an error when the connection or channel fails. In
+// confirm mode, up to maxInFlight messages wait for their confirmation and
+// closing also waits for them.
+func (p *publisher) publishQueued() error {
+	connClosed := p.conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := p.ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	// Every publish is confirmed or returned at most once, so the buffers
+	// never fill up and block the connection
+	var confirms chan amqp.Confirmation
+	if p.confirm {
+		confirms = p.ch.NotifyPublish(make(chan amqp.Confirmation, p.maxInFlight))
+	}
+	returns := p.ch.NotifyReturn(make(chan amqp.Return, p.maxInFlight+1))
+
+	// Unconfirmed messages are published again on the next channel
+	defer p.requeueInFlight()
+
+	for {
+		queued := p.pending()
+		idle := !queued && len(p.inFlight) == 0
+		if idle && stopped(p.closing) {
+			return nil
+		}
+
+		// Publish if there is room in flight, otherwise wait for a message,
+		// a notification or the publisher to close
+		var publish, closing <-chan struct{}
+		if queued && (!p.confirm || len(p.inFlight) < p.maxInFlight) {
+			publish = closedChan
+		}
+		if idle {
+			closing = p.closing
+		}
+
+		select {
+		case <-publish:
+			// The message is off the queue while it is published, so that
+			// dropping the oldest message cannot drop it
+			m, ok := p.take()
+			if !ok {
+				break
+			}
+			if err := p.publishMessage(m); err != nil {
+				// The message is published again after reconnecting
+				atomic.AddUint64(&p.failures, 1)
+				p.requeue([]*message{&m})
+				return err
+			}
+		case <-p.wake:
+		case <-closing:
+		case c, ok := <-confirms:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			// The return of a message is dispatched before its confirmation,
+			// but select picks among ready channels at random
+			if !p.drainReturns(returns) {
+				return amqp.ErrClosed
+			}
+			p.confirmed(c)
+		case r, ok := <-returns:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			p.returned(r)
+		case <-p.abort:
+			return nil
+		case err := <-connClosed:
+			return closeError(err)
+		case err := <-chClosed:
+			return closeError(err)
+		}
+	}
+}
+
+// publishMessage publishes a message, keeping it until it is confirmed in
+// confirm mode.
+func (p *publisher) publishMessage(m message) error {
+	// Send JSON to RabbitMQ exchange
+	err := p.ch.Publish(
+		p.settings.Exchange.Name,
+		m.key,
+		p.settings.Publish.Mandatory,
+		p.settings.Publish.Immediate,
+		m.msg)
+	if err != nil {
+		return err
+	}
+
+	if p.confirm {
+		m.attempts++
+		p.inFlight = append(p.inFlight, &m)
+	}
+
+	return nil
+}
+
+// confirmed handles the confirmation of the oldest message in flight.
+// Confirmations arrive in the order of the publishes. Nacked and returned
+// messages are published again up to maxRetries times, then counted.
+func (p *publisher) confirmed(c amqp.Confirmation) {
+	if len(p.inFlight) == 0 {
+		return
+	}
+	m := p.inFlight[0]
+	p.inFlight = p.inFlight[1:]
+
+	switch {
+	case c.Ack && !m.returned:
+		return
+	case m.attempts <= p.maxRetries:
+		m.returned = false
+		p.requeue([]*message{m})
+	case m.returned:
+		log.Println("Failed to route record to a queue after", m.attempts, "attempts")
+		atomic.AddUint64(&p.returnedCount, 1)
+	default:
+		log.Println("Failed to get record confirmed after", m.attempts, "attempts")
+		atomic.AddUint64(&p.unconfirmed, 1)
+	}
+}
+
+// drainReturns handles the returns already received, without waiting. It
+// returns false if the channel of returns is closed.
+func (p *publisher) drainReturns(returns chan amqp.Return) bool {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return false
+			}
+			p.returned(r)
+		default:
+			return true
+		}
+	}
+}
+
+// returned handles a message returned as unroutable. In confirm mode the
+// message, found by its unique id, is retried or counted on its
+// confirmation, which follows and is only handled once the returns
+// received before it are.
+func (p *publisher) returned(r amqp.Return) {
+	if p.confirm {
+		for _, m := range p.inFlight {
+			if m.msg.MessageId == r.MessageId {
+				m.returned = true
+				return
+			}
+		}
+	}
+
+	log.Println("Failed to route record to a queue:", r.ReplyText)
+	atomic.AddUint64(&p.returnedCount, 1)
+}
+
+// requeueInFlight queues the unconfirmed messages again, ahead of the
+// others, when the channel is lost. Losing the channel does not count as a
+// failed attempt.
+func (p *publisher) requeueInFlight() {
+	for _, m := range p.inFlight {
+		m.attempts--
+	}
+	if len(p.inFlight) > 0 {
+		p.requeue(p.inFlight)
+		p.inFlight = nil
+	}
+}
+
+// closeError converts the error of a close notification, which is nil if
+// the connection or channel was closed normally.
+func closeError(err *amqp.Error) error {
+	if err == nil {
+		return amqp.ErrClosed
+	}
+	return err
+}
+
+// publish queues a message with its routing key. When the buffer is full,
+// the oldest or the new message is dropped depending on the drop policy.
+func (p *publisher) publish(key string, msg amqp.Publishing) {
+	p.mu.Lock()
+	if len(p.queue) >= p.bufferSize {
+		if !p.dropping {
+			log.Println("RabbitMQ buffer is full, dropping the", p.dropPolicy, "records")
+			p.dropping = true
+		}
+		atomic.AddUint64(&p.dropped, 1)
+
+		if p.dropPolicy == dropNewest {
+			p.mu.Unlock()
+			return
+		}
+		p.queue = p.queue[1:]
+	}
+	p.queue = append(p.queue, message{key: key, msg: msg})
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts messages back at the front of the queue, even if it is
+// full, to publish them again.
+func (p *publisher) requeue(messages []*message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queue := make([]message, 0, len(messages)+len(p.queue))
+	for _, m := range messages {
+		queue = append(queue, *m)
+	}
+	p.queue = append(queue, p.queue...)
+}
+
+// pending reports whether messages are queued.
+func (p *publisher) pending() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.queue) > 0
+}
+
+// take removes the first queued message to publish it.
+func (p *publisher) take() (message, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) == 0 {
+		return message{}, false
+	}
+	m := p.queue[0]
+	p.queue = p.queue[1:]
+	p.dropping = false
+
+	return m, true
+}
+
+// close publishes the queued messages and closes the connection. Messages
+// that cannot be published, or confirmed, within the flush timeout are
+// dropped.
+func (p *publisher) close() {
+	close(p.closing)
+
+	select {
+	case <-p.done:
+	case <-time.After(p.flushTimeout):
+		close(p.abort)
+		<-p.done
+	}
+
+	p.mu.Lock()
+	if n := len(p.queue); n > 0 {
+		log.Println("Failed to flush", n, "records to RabbitMQ before closing")
+		atomic.AddUint64(&p.dropped, uint64(n))
+		p.queue = nil
+	}
+	p.mu.Unlock()
+}
+
+// publishCounters holds the counters of a publisher
+type publishCounters struct {
+	// Failures is the number of failed publishes
+	Failures uint64
+	// Dropped is the number of records dropped from the buffer
+	Dropped uint64
+	// Unconfirmed is the number of records nacked by the broker on every
+	// attempt
+	Unconfirmed uint64
+	// Returned is the number of records returned as unroutable on every
+	// attempt
+	Returned uint64
+}
+
+// counters returns the counters of the publisher.
+func (p *publisher) counters() publishCounters {
+	return publishCounters{
+		Failures:    atomic.LoadUint64(&p.failures),
+		Dropped:     atomic.LoadUint64(&p.dropped),
+		Unconfirmed: atomic.LoadUint64(&p.unconfirmed),
+		Returned:    atomic.LoadUint64(&p.returnedCount),
+	}
+}
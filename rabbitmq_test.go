@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// testPublisher returns a publisher with a buffer of a size, without a
+// connection.
+func testPublisher(size int, dropPolicy string) *publisher {
+	return &publisher{
+		bufferSize: size,
+		dropPolicy: dropPolicy,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// publishRecords queues records with ids from first to last.
+func publishRecords(p *publisher, first, last int) {
+	for i := first; i <= last; i++ {
+		p.publish("packets", amqp.Publishing{MessageId: strconv.Itoa(i)})
+	}
+}
+
+func TestPublisherDropWhilePublishing(t *testing.T) {
+	for _, dropPolicy := range []string{dropOldest, dropNewest} {
+		for _, fails := range []bool{false, true} {
+			p := testPublisher(3, dropPolicy)
+			publishRecords(p, 0, 2)
+
+			// The buffer fills up while the first message is published, as
+			// publishQueued does without holding the lock
+			m, ok := p.take()
+			if !ok || m.msg.MessageId != "0" {
+				t.Fatalf("%s: took %q, want 0", dropPolicy, m.msg.MessageId)
+			}
+			publishRecords(p, 3, 9)
+
+			sent := make(map[string]bool)
+			if fails {
+				p.requeue([]*message{&m})
+			} else {
+				sent[m.msg.MessageId] = true
+			}
+
+			queued := len(p.queue)
+			if fails && p.queue[0].msg.MessageId != "0" {
+				t.Errorf("%s: requeued message is %q, want 0", dropPolicy, p.queue[0].msg.MessageId)
+			}
+			for {
+				m, ok := p.take()
+				if !ok {
+					break
+				}
+				if sent[m.msg.MessageId] {
+					t.Errorf("%s: message %s sent twice", dropPolicy, m.msg.MessageId)
+				}
+				sent[m.msg.MessageId] = true
+			}
+
+			dropped := int(atomic.LoadUint64(&p.dropped))
+			want := queued
+			if !fails {
+				want++
+			}
+			if len(sent) != want {
+				t.Errorf("%s, failed %v: sent %d messages, want %d", dropPolicy, fails, len(sent), want)
+			}
+			if n := len(sent) + dropped; n != 10 {
+				t.Errorf("%s, failed %v: %d sent and %d dropped, want 10 records in all", dropPolicy, fails, len(sent), dropped)
+			}
+			if !sent["0"] {
+				t.Errorf("%s, failed %v: message being published was dropped", dropPolicy, fails)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Value of missing fields in routing keys, unless configured
+const defaultKeyFallback = "unknown"
+
+// routingKeyField matches the field paths of routing key placeholders
+var routingKeyField = regexp.MustCompile(`^\.[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// routingKey is a routing key template. Each {{.field.path}} placeholder is
+// replaced by the field of the record with the same JSON path, or by the
+// fallback if the record has no such field.
+type routingKey struct {
+	// literals holds the text around the placeholders, one more than fields
+	literals []string
+	fields   [][]string
+	fallback string
+}
+
+// parseRoutingKey parses a routing key template.
+func parseRoutingKey(key, fallback string) (*routingKey, error) {
+	k := &routingKey{fallback: fallback}
+	if k.fallback == "" {
+		k.fallback = defaultKeyFallback
+	}
+
+	rest := key
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			k.literals = append(k.literals, rest)
+			return k, nil
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in routing key %q", key)
+		}
+
+		path := strings.TrimSpace(rest[start+2 : start+end])
+		if !routingKeyField.MatchString(path) {
+			return nil, fmt.Errorf("invalid placeholder %q in routing key %q", path, key)
+		}
+
+		k.literals = append(k.literals, rest[:start])
+		k.fields = append(k.fields, strings.Split(path[1:], "."))
+		rest = rest[start+end+2:]
+	}
+}
+
+// static reports whether the routing key is the same for every record.
+func (k *routingKey) static() bool {
+	return len(k.fields) == 0
+}
+
+// expand returns the routing key of a record marshalled to JSON.
+func (k *routingKey) expand(record []byte) string {
+	if k.static() {
+		return k.literals[0]
+	}
+
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(record))
+	// Keep numbers as they were marshalled
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		fields = nil
+	}
+
+	var b strings.Builder
+	for i, path := range k.fields {
+		b.WriteString(k.literals[i])
+		b.WriteString(k.lookup(fields, path))
+	}
+	b.WriteString(k.literals[len(k.literals)-1])
+
+	return b.String()
+}
+
+// lookup returns the value of a field as a string, or the fallback if the
+// field is missing, null, empty or not a scalar. Dots in the value are
+// replaced by underscores, so that it is a single word of a topic routing
+// key.
+func (k *routingKey) lookup(fields map[string]interface{}, path []string) string {
+	if value, ok := lookupField(fields, path); ok && value != "" {
+		return strings.Replace(value, ".", "_", -1)
+	}
+	return k.fallback
+}
+
+// lookupField returns the value of the field of a decoded JSON record at a
+// path as a string. It reports false if the field is missing, null or not
+// a scalar. Numbers must have been decoded as json.Number.
+func lookupField(fields map[string]interface{}, path []string) (string, bool) {
+	switch v := fieldValue(fields, path).(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprint(v), true
+	}
+
+	return "", false
+}
+
+// fieldValue returns the value of the field of a decoded JSON record at a
+// path, or nil if it is missing.
+func fieldValue(fields map[string]interface{}, path []string) interface{} {
+	var value interface{} = fields
+	for _, name := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+
+	return value
+}
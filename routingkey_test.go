@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRoutingKey(t *testing.T) {
+	record := []byte(`{"ipv4":{"protocol":"UDP","ttl":64,"source_address":""},` +
+		`"tcp":{"flags":["SYN"]},"udp":{"destination_port":53},"dns":{"truncated":false},` +
+		`"hostname":"sensor.example.com","empty":null}`)
+
+	tests := []struct {
+		key      string
+		fallback string
+		want     string
+	}{
+		{"packets", "", "packets"},
+		{"packets.{{.ipv4.protocol}}", "", "packets.UDP"},
+		{"{{ .ipv4.ttl }}.{{.udp.destination_port}}", "", "64.53"},
+		{"{{.dns.truncated}}", "", "false"},
+		{"{{.hostname}}", "", "sensor_example_com"},
+		{"packets.{{.hostname}}.{{.ipv4.protocol}}", "", "packets.sensor_example_com.UDP"},
+		{"packets.{{.ipv6.next_header}}", "", "packets.unknown"},
+		{"packets.{{.ipv6.next_header}}", "none", "packets.none"},
+		{"{{.ipv4.source_address}}", "", "unknown"},
+		{"{{.empty}}", "", "unknown"},
+		{"{{.tcp.flags}}", "", "unknown"},
+		{"{{.ipv4}}", "", "unknown"},
+		{"{{.ipv4.protocol.name}}", "", "unknown"},
+	}
+
+	for _, test := range tests {
+		k, err := parseRoutingKey(test.key, test.fallback)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.key, err)
+			continue
+		}
+		if got := k.expand(record); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestRoutingKeyInvalidRecord(t *testing.T) {
+	k, err := parseRoutingKey("packets.{{.ipv4.protocol}}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := k.expand([]byte("not json")); got != "packets.unknown" {
+		t.Errorf("got %q, want %q", got, "packets.unknown")
+	}
+}
+
+func TestParseRoutingKeyErrors(t *testing.T) {
+	tests := []string{
+		"packets.{{.ipv4.protocol",
+		"packets.{{ipv4}}",
+		"packets.{{.}}",
+		"packets.{{.ipv4..protocol}}",
+		"packets.{{.ipv4-protocol}}",
+	}
+
+	for _, key := range tests {
+		if _, err := parseRoutingKey(key, ""); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// envReference matches ${NAME} references to environment variables, and
+// $${NAME} escapes of them
+var envReference = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references of a setting by the values of
+// the environment variables. A reference to a variable that is not set is
+// an error.
+func expandEnv(s string) (string, error) {
+	var missing string
+
+	s = envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		match := envReference.FindStringSubmatch(ref)
+		if match[1] != "" {
+			return ref[1:]
+		}
+
+		value, ok := os.LookupEnv(match[2])
+		if !ok && missing == "" {
+			missing = match[2]
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set", missing)
+	}
+
+	return s, nil
+}
+
+// resolveSecrets expands the environment variable references of every
+// string setting and reads the settings given as <name>_file from files.
+// raw is the same configuration decoded without a type, to find the _file
+// keys, and path the JSON path of v. It returns a problem for every secret
+// that cannot be resolved.
+func resolveSecrets(v reflect.Value, raw interface{}, path string) []configProblem {
+	var problems []configProblem
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return resolveSecrets(v.Elem(), raw, path)
+	case reflect.Struct:
+		object, _ := raw.(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			name := jsonName(v.Type().Field(i))
+			if name == "" {
+				continue
+			}
+			fieldPath := jsonPath(path, name)
+
+			if file, ok := object[name+"_file"]; ok && v.Field(i).Kind() == reflect.String {
+				if v.Field(i).String() != "" {
+					problems = append(problems, configProblem{fieldPath, fmt.Sprintf("both %s and %s_file are set", name, name)})
+					continue
+				}
+				value, err := readSecret(file)
+				if err != nil {
+					problems = append(problems, configProblem{fieldPath + "_file", err.Error()})
+					continue
+				}
+				v.Field(i).SetString(value)
+				continue
+			}
+
+			problems = append(problems, resolveSecrets(v.Field(i), object[name], fieldPath)...)
+		}
+	case reflect.Slice:
+		array, _ := raw.([]interface{})
+		for i := 0; i < v.Len(); i++ {
+			var element interface{}
+			if i < len(array) {
+				element = array[i]
+			}
+			problems = append(problems, resolveSecrets(v.Index(i), element, path+"["+strconv.Itoa(i)+"]")...)
+		}
+	case reflect.String:
+		s, err := expandEnv(v.String())
+		if err != nil {
+			return []configProblem{{path, err.Error()}}
+		}
+		v.SetString(s)
+	}
+
+	return problems
+}
+
+// readSecret returns the content of the file named by a _file setting,
+// without its trailing newline.
+func readSecret(file interface{}) (string, error) {
+	name, ok := file.(string)
+	if !ok || name == "" {
+		return "", errors.New("must be the path of a file")
+	}
+
+	name, err := expandEnv(name)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %v", err)
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// jsonName returns the JSON key of a struct field, or an empty string if it
+// is not marshalled.
+func jsonName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+
+	return name
+}
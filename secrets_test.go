@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("NOSE_BLEED_TEST_USER", "guest")
+	os.Setenv("NOSE_BLEED_TEST_EMPTY", "")
+	os.Unsetenv("NOSE_BLEED_TEST_MISSING")
+	defer os.Unsetenv("NOSE_BLEED_TEST_USER")
+	defer os.Unsetenv("NOSE_BLEED_TEST_EMPTY")
+
+	tests := []struct {
+		s    string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"guest", "guest", true},
+		{"${NOSE_BLEED_TEST_USER}", "guest", true},
+		{"user-${NOSE_BLEED_TEST_USER}-${NOSE_BLEED_TEST_USER}", "user-guest-guest", true},
+		{"${NOSE_BLEED_TEST_EMPTY}", "", true},
+		{"$${NOSE_BLEED_TEST_USER}", "${NOSE_BLEED_TEST_USER}", true},
+		{"$${NOSE_BLEED_TEST_MISSING}", "${NOSE_BLEED_TEST_MISSING}", true},
+		{"$$${NOSE_BLEED_TEST_USER}", "$${NOSE_BLEED_TEST_USER}", true},
+		{"$NOSE_BLEED_TEST_USER", "$NOSE_BLEED_TEST_USER", true},
+		{"${}", "${}", true},
+		{"${1A}", "${1A}", true},
+		{"p@$$word", "p@$$word", true},
+		{"${NOSE_BLEED_TEST_MISSING}", "", false},
+		{"${NOSE_BLEED_TEST_USER}:${NOSE_BLEED_TEST_MISSING}", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := expandEnv(test.s)
+		if test.ok && err != nil {
+			t.Errorf("%q: unexpected error: %v", test.s, err)
+			continue
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: expected an error", test.s)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+// secretSettings holds settings of the kinds resolveSecrets walks through.
+type secretSettings struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Port     int    `json:"port"`
+	Nested   *struct {
+		Key string `json:"key"`
+	} `json:"nested"`
+	Names []string `json:"names"`
+	// Unexported fields are skipped
+	ignored string
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nose-bleed-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(secret, []byte("s3cret\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NOSE_BLEED_TEST_DIR", dir)
+	os.Unsetenv("NOSE_BLEED_TEST_MISSING")
+	defer os.Unsetenv("NOSE_BLEED_TEST_DIR")
+
+	tests := []struct {
+		name     string
+		config   string
+		password string
+		key      string
+		names    []string
+		problems []configProblem
+	}{
+		{
+			name:     "file",
+			config:   `{"password_file": "` + secret + `"}`,
+			password: "s3cret",
+		},
+		{
+			name:     "file with reference",
+			config:   `{"password_file": "${NOSE_BLEED_TEST_DIR}/password"}`,
+			password: "s3cret",
+		},
+		{
+			name:   "references",
+			config: `{"nested": {"key": "${NOSE_BLEED_TEST_DIR}"}, "names": ["a", "$${NOSE_BLEED_TEST_DIR}"]}`,
+			key:    dir,
+			names:  []string{"a", "${NOSE_BLEED_TEST_DIR}"},
+		},
+		{
+			name:     "both set",
+			config:   `{"password": "x", "password_file": "` + secret + `"}`,
+			password: "x",
+			problems: []configProblem{{"password", "both password and password_file are set"}},
+		},
+		{
+			name:     "missing file",
+			config:   `{"password_file": "` + filepath.Join(dir, "missing") + `"}`,
+			problems: []configProblem{{"password_file", ""}},
+		},
+		{
+			name:     "file not a string",
+			config:   `{"password_file": 1}`,
+			problems: []configProblem{{"password_file", "must be the path of a file"}},
+		},
+		{
+			name:     "empty file name",
+			config:   `{"password_file": ""}`,
+			problems: []configProblem{{"password_file", "must be the path of a file"}},
+		},
+		{
+			name:     "file with missing reference",
+			config:   `{"password_file": "${NOSE_BLEED_TEST_MISSING}"}`,
+			problems: []configProblem{{"password_file", "environment variable NOSE_BLEED_TEST_MISSING is not set"}},
+		},
+		{
+			name:   "missing references",
+			config: `{"user": "${NOSE_BLEED_TEST_MISSING}", "nested": {"key": "${NOSE_BLEED_TEST_MISSING}"}, "names": ["a", "${NOSE_BLEED_TEST_MISSING}"]}`,
+			names:  []string{"a", "${NOSE_BLEED_TEST_MISSING}"},
+			key:    "${NOSE_BLEED_TEST_MISSING}",
+			problems: []configProblem{
+				{"user", "environment variable NOSE_BLEED_TEST_MISSING is not set"},
+				{"nested.key", "environment variable NOSE_BLEED_TEST_MISSING is not set"},
+				{"names[1]", "environment variable NOSE_BLEED_TEST_MISSING is not set"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var settings secretSettings
+		var raw interface{}
+		if err := json.Unmarshal([]byte(test.config), &settings); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := json.Unmarshal([]byte(test.config), &raw); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		problems := resolveSecrets(reflect.ValueOf(&settings), raw, "")
+
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: got problems %v, want %v", test.name, problems, test.problems)
+			continue
+		}
+		for i, problem := range problems {
+			want := test.problems[i]
+			// Messages from the file system vary, only their path is compared
+			if problem.Path != want.Path || want.Message != "" && problem.Message != want.Message {
+				t.Errorf("%s: got problem %v, want %v", test.name, problem, want)
+			}
+		}
+		if settings.Password != test.password {
+			t.Errorf("%s: got password %q, want %q", test.name, settings.Password, test.password)
+		}
+		if settings.Nested != nil && settings.Nested.Key != test.key {
+			t.Errorf("%s: got key %q, want %q", test.name, settings.Nested.Key, test.key)
+		}
+		if test.names != nil && !reflect.DeepEqual(settings.Names, test.names) {
+			t.Errorf("%s: got names %q, want %q", test.name, settings.Names, test.names)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exit statuses
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	// Status of a second signal, added to the signal number like a shell does
+	exitSignalBase = 128
+)
+
+// handleSignals returns a channel that is closed on the first SIGINT or
+// SIGTERM, asking the captures to stop and the outputs to be flushed. A
+// second signal exits immediately, skipping the cleanup.
+func handleSignals() <-chan struct{} {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	stop := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		log.Println("Received", sig.String()+", shutting down")
+		close(stop)
+
+		sig = <-sigs
+		log.Println("Received", sig.String(), "again, exiting without cleanup")
+		fmt.Fprintln(os.Stderr, "Received", sig.String(), "again, exiting without cleanup")
+		os.Exit(exitSignalBase + int(sig.(syscall.Signal)))
+	}()
+
+	return stop
+}
+
+// stopped reports whether stop has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail logs a fatal error to the log file and standard error and returns
+// the exit status for it.
+func fail(v ...interface{}) int {
+	log.Println(v...)
+	fmt.Fprintln(os.Stderr, v...)
+	return exitFailure
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// interfaceStats holds the capture counters of an interface in a stats record
+type interfaceStats struct {
+	Interface string `json:"interface"`
+	Received  uint64 `json:"received"`
+	Dropped   uint64 `json:"dropped"`
+	IfDropped uint64 `json:"if_dropped"`
+}
+
+// statsRecord is the record periodically sent with the capture statistics.
+// Records of capture files have no interfaces.
+type statsRecord struct {
+	Type            string           `json:"type"`
+	Timestamp       string           `json:"timestamp"`
+	Final           bool             `json:"final"`
+	Interfaces      []interfaceStats `json:"interfaces,omitempty"`
+	PacketsRead     int              `json:"packets_read"`
+	PacketsParsed   int              `json:"packets_parsed"`
+	ParseFailures   map[string]int   `json:"parse_failures"`
+	MarshalFailures uint64           `json:"marshal_failures"`
+	PublishFailures uint64           `json:"publish_failures"`
+	DroppedRecords  uint64           `json:"dropped_records"`
+	// Records nacked or returned by the broker on every attempt
+	UnconfirmedRecords uint64 `json:"unconfirmed_records"`
+	ReturnedRecords    uint64 `json:"returned_records"`
+}
+
+// sendStats sends a stats record with the counters of the captures, the
+// pipeline summary and the output.
+func sendStats(captures []*liveCapture, summary *captureSummary, out *output, final bool) {
+	// Without the monotonic clock reading, String formats the time like
+	// the timestamps of packet records
+	now := time.Now().Round(0)
+	counters := out.publishCounters()
+	record := statsRecord{
+		Type:               recordStats,
+		Timestamp:          now.String(),
+		Final:              final,
+		Interfaces:         make([]interfaceStats, 0, len(captures)),
+		PacketsRead:        summary.Read,
+		PacketsParsed:      summary.Parsed,
+		ParseFailures:      make(map[string]int),
+		MarshalFailures:    out.marshalFailures,
+		PublishFailures:    counters.Failures,
+		DroppedRecords:     counters.Dropped,
+		UnconfirmedRecords: counters.Unconfirmed,
+		ReturnedRecords:    counters.Returned,
+	}
+
+	for protocol, failures := range summary.FailedByProtocol {
+		record.ParseFailures[protocol] = failures
+	}
+
+	for _, c := range captures {
+		stats, err := c.stats()
+		if err != nil {
+			log.Println("Failed to get capture statistics for", c.device+":", err)
+			continue
+		}
+
+		record.Interfaces = append(record.Interfaces, interfaceStats{
+			Interface: c.device,
+			Received:  stats.Received,
+			Dropped:   stats.Dropped,
+			IfDropped: stats.IfDropped,
+		})
+
+		if final {
+			log.Printf("Captured %d packets on %s (%d dropped, %d dropped by interface)",
+				stats.Received, c.device, stats.Dropped, stats.IfDropped)
+		}
+	}
+
+	out.send(record, recordInfo{Type: recordStats, Timestamp: now})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// TLS versions by name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Minimum TLS version, unless configured
+const defaultTLSMinVersion = "1.2"
+
+// TLS 1.0 to 1.2 cipher suites by name. TLS 1.3 suites cannot be configured.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// errPinMismatch is returned when no certificate of the server matches
+// the pinned public keys
+var errPinMismatch = errors.New("no certificate of the server matches the pinned SPKI hashes")
+
+// newTLSConfig creates the TLS configuration of the RabbitMQ connection.
+// Unlike a missing setting, a file that cannot be read or an unknown
+// value is an error.
+func newTLSConfig(settings RabbitMQTLSSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+
+	// The system roots are trusted unless a CA file is given
+	if settings.CACertFile != "" {
+		ca, err := ioutil.ReadFile(settings.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", settings.CACertFile)
+		}
+	}
+
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Log the certificate presented, if any, as the server asks for it
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if len(tlsConfig.Certificates) == 0 {
+			log.Println("RabbitMQ requested a client certificate, but none is configured")
+			return new(tls.Certificate), nil
+		}
+
+		leaf := tlsConfig.Certificates[0].Leaf
+		log.Printf("Presenting client certificate %s (issuer %s, serial %s, expires %s) to RabbitMQ",
+			leaf.Subject, leaf.Issuer, leaf.SerialNumber, leaf.NotAfter.Format("2006-01-02"))
+		return &tlsConfig.Certificates[0], nil
+	}
+
+	version, err := tlsVersion(settings.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion = version
+
+	for _, name := range settings.CipherSuites {
+		suite, err := tlsCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite)
+	}
+
+	if len(settings.PinnedSPKISHA256) > 0 {
+		var pins [][]byte
+		for _, pin := range settings.PinnedSPKISHA256 {
+			hash, err := parsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, hash)
+		}
+		tlsConfig.VerifyPeerCertificate = pinVerifier(pins, settings.InsecureSkipVerify)
+	}
+
+	if settings.InsecureSkipVerify {
+		warning := "WARNING: RabbitMQ server certificates are not verified (insecure_skip_verify), " +
+			"the connection can be intercepted"
+		if len(settings.PinnedSPKISHA256) > 0 {
+			warning += " unless the key of the server itself is pinned"
+		}
+		log.Println(warning)
+		fmt.Fprintln(os.Stderr, warning)
+	}
+
+	return tlsConfig, nil
+}
+
+// tlsVersion returns the TLS version with a name, or the default minimum
+// version for an empty name.
+func tlsVersion(name string) (uint16, error) {
+	if name == "" {
+		name = defaultTLSMinVersion
+	}
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// tlsCipherSuite returns the cipher suite with a name.
+func tlsCipherSuite(name string) (uint16, error) {
+	suite, ok := tlsCipherSuites[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown or unsupported cipher suite %q", name)
+	}
+	return suite, nil
+}
+
+// parsePin decodes a base64 SHA-256 hash of a public key.
+func parsePin(pin string) ([]byte, error) {
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q, expected a base64 SHA-256 hash", pin)
+	}
+	return hash, nil
+}
+
+// pinVerifier returns a VerifyPeerCertificate callback that checks the
+// pinned public keys. The certificates sent by the server can include any
+// public certificate, so only the verified chains are checked, or only the
+// server certificate itself when verification is skipped.
+func pinVerifier(pins [][]byte, insecureSkipVerify bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if insecureSkipVerify {
+			if len(rawCerts) == 0 {
+				return errPinMismatch
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			return verifyPins([]*x509.Certificate{leaf}, pins)
+		}
+
+		for _, chain := range verifiedChains {
+			if verifyPins(chain, pins) == nil {
+				return nil
+			}
+		}
+		return errPinMismatch
+	}
+}
+
+// verifyPins checks that one of the certificates has a pinned public key.
+func verifyPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	return errPinMismatch
+}
+
+// rabbitMQTLSConfig returns the TLS configuration of the RabbitMQ
+// connection, or nil if no node is connected to with TLS.
+func rabbitMQTLSConfig(settings RabbitMQSettings) (*tls.Config, error) {
+	eps, err := endpoints(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ep := range eps {
+		if ep.tls {
+			tlsConfig, err := newTLSConfig(settings.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RabbitMQ TLS settings: %v", err)
+			}
+			return tlsConfig, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a self-signed certificate.
+func testCertificate(t *testing.T, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPinVerifier(t *testing.T) {
+	pinned := testCertificate(t, "pinned")
+	other := testCertificate(t, "other")
+	hash := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+	pins := [][]byte{hash[:]}
+
+	tests := []struct {
+		name     string
+		insecure bool
+		rawCerts [][]byte
+		chains   [][]*x509.Certificate
+		ok       bool
+	}{
+		{"verified chain with pin", false, [][]byte{other.Raw}, [][]*x509.Certificate{{other, pinned}}, true},
+		{"pinned certificate only sent", false, [][]byte{other.Raw, pinned.Raw}, [][]*x509.Certificate{{other}}, false},
+		{"no verified chain", false, [][]byte{pinned.Raw}, nil, false},
+		{"insecure pinned leaf", true, [][]byte{pinned.Raw, other.Raw}, nil, true},
+		{"insecure pinned certificate after leaf", true, [][]byte{other.Raw, pinned.Raw}, nil, false},
+		{"insecure no certificates", true, nil, nil, false},
+	}
+
+	for _, test := range tests {
+		err := pinVerifier(pins, test.insecure)(test.rawCerts, test.chains)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.ok && err != errPinMismatch {
+			t.Errorf("%s: got %v, want %v", test.name, err, errPinMismatch)
+		}
+	}
+}
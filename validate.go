@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Exchange types built into RabbitMQ. Plugins add types starting with x-.
+var exchangeTypes = map[string]bool{
+	"direct":  true,
+	"fanout":  true,
+	"topic":   true,
+	"headers": true,
+}
+
+// configProblem is a problem found in a configuration file, at the JSON
+// path of the setting at fault
+type configProblem struct {
+	Path    string
+	Message string
+}
+
+func (p configProblem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// configError is the error of a configuration file with problems
+type configError []configProblem
+
+func (e configError) Error() string {
+	problems := make([]string, len(e))
+	for i, p := range e {
+		problems[i] = p.String()
+	}
+	return "invalid settings:\n  " + strings.Join(problems, "\n  ")
+}
+
+// sinkStatus tells whether records would be sent to a sink
+type sinkStatus struct {
+	Name    string
+	Enabled bool
+	Reason  string
+}
+
+// jsonPath returns the JSON path of a key of the object at a path.
+func jsonPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// validateSettings decodes and checks the settings of a configuration
+// file. Only a file that is not JSON is an error; every other problem is
+// returned with the settings.
+func validateSettings(data []byte) (*Settings, []configProblem, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal JSON settings: %v", err)
+	}
+
+	settings := new(Settings)
+	problems := keyProblems(reflect.TypeOf(settings).Elem(), raw, "")
+
+	// Values of the wrong type, reported above, are left unset
+	if err := json.Unmarshal(data, settings); err != nil {
+		e, ok := err.(*json.UnmarshalTypeError)
+		if !ok {
+			return settings, append(problems, configProblem{"", err.Error()}), nil
+		}
+		if len(problems) == 0 {
+			problems = append(problems, configProblem{e.Field, fmt.Sprintf("expected %s, got %s", e.Type, e.Value)})
+		}
+	}
+
+	problems = append(problems, resolveSecrets(reflect.ValueOf(settings), raw, "")...)
+
+	// Settings already at fault would also be reported as missing or invalid
+	reported := make(map[string]bool)
+	for _, p := range problems {
+		reported[p.Path] = true
+		reported[strings.TrimSuffix(p.Path, "_file")] = true
+	}
+	for _, p := range checkRabbitMQSettings(settings.RabbitMQ, "rabbitmq") {
+		if !reported[p.Path] {
+			problems = append(problems, p)
+		}
+	}
+
+	return settings, problems, nil
+}
+
+// keyProblems returns a problem for every key of the decoded configuration
+// that does not match a setting of type t, or the _file variant of a
+// string setting, and for every value of the wrong type.
+func keyProblems(t reflect.Type, raw interface{}, path string) []configProblem {
+	if raw == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		return keyProblems(t.Elem(), raw, path)
+	}
+	if expected := typeMismatch(t, raw); expected != "" {
+		return []configProblem{{path, "expected " + expected}}
+	}
+
+	var problems []configProblem
+
+	switch t.Kind() {
+	case reflect.Slice:
+		for i, element := range raw.([]interface{}) {
+			problems = append(problems, keyProblems(t.Elem(), element, path+"["+strconv.Itoa(i)+"]")...)
+		}
+	case reflect.Struct:
+		object := raw.(map[string]interface{})
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field, ok := settingField(t, key)
+			if ok {
+				problems = append(problems, keyProblems(field.Type, object[key], jsonPath(path, key))...)
+				continue
+			}
+
+			// Secrets read from files
+			if field, ok := settingField(t, strings.TrimSuffix(key, "_file")); ok && strings.HasSuffix(key, "_file") &&
+				field.Type.Kind() == reflect.String {
+				continue
+			}
+
+			problems = append(problems, configProblem{jsonPath(path, key), "unknown setting"})
+		}
+	}
+
+	return problems
+}
+
+// typeMismatch describes the JSON value expected for a setting of type t,
+// or returns an empty string if the decoded value raw has the right type.
+func typeMismatch(t reflect.Type, raw interface{}) string {
+	switch t.Kind() {
+	case reflect.String:
+		if _, ok := raw.(string); !ok {
+			return "a string"
+		}
+	case reflect.Bool:
+		if _, ok := raw.(bool); !ok {
+			return "true or false"
+		}
+	case reflect.Int, reflect.Int64:
+		if n, ok := raw.(float64); !ok || n != math.Trunc(n) {
+			return "an integer"
+		}
+	case reflect.Slice:
+		if _, ok := raw.([]interface{}); !ok {
+			return "an array"
+		}
+	case reflect.Struct:
+		if _, ok := raw.(map[string]interface{}); !ok {
+			return "an object"
+		}
+	}
+
+	return ""
+}
+
+// settingField returns the field of a settings struct with a JSON key,
+// matched without case like encoding/json does.
+func settingField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if name != "" && strings.EqualFold(name, key) {
+			return t.Field(i), true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// rabbitMQEnabled reports whether records are sent to RabbitMQ, which
+// needs an exchange and either URIs or a host with credentials.
+func rabbitMQEnabled(settings RabbitMQSettings) bool {
+	hasHost := settings.User != "" && settings.Password != "" && (settings.Host != "" || len(settings.Hosts) > 0)
+	return (hasHost || len(settings.URIs) > 0) && settings.Exchange.Name != "" && settings.Exchange.Type != ""
+}
+
+// rabbitMQConfigured reports whether any RabbitMQ connection setting is
+// given, in which case RabbitMQ must be fully configured.
+func rabbitMQConfigured(settings RabbitMQSettings) bool {
+	return len(settings.URIs) > 0 || settings.User != "" || settings.Password != "" || settings.Host != "" ||
+		len(settings.Hosts) > 0 || settings.Exchange.Name != "" || settings.Exchange.Type != ""
+}
+
+// checkRabbitMQSettings returns the problems of the RabbitMQ settings at a
+// JSON path.
+func checkRabbitMQSettings(settings RabbitMQSettings, path string) []configProblem {
+	var problems []configProblem
+	problem := func(key, format string, a ...interface{}) {
+		problems = append(problems, configProblem{jsonPath(path, key), fmt.Sprintf(format, a...)})
+	}
+
+	if !rabbitMQConfigured(settings) {
+		return nil
+	}
+
+	// Connection
+	if len(settings.URIs) == 0 && settings.Host == "" && len(settings.Hosts) == 0 {
+		problem("host", "missing, set host, hosts or uris")
+	}
+	if settings.Host != "" || len(settings.Hosts) > 0 {
+		if settings.User == "" {
+			problem("user", "missing")
+		}
+		if settings.Password == "" {
+			problem("password", "missing")
+		}
+	}
+	usesTLS := settings.TLS.Enabled
+	for i, uri := range settings.URIs {
+		u, err := parseAMQPURI(uri)
+		if err != nil {
+			problem("uris["+strconv.Itoa(i)+"]", "%v", err)
+		} else if u.Scheme == "amqps" {
+			usesTLS = true
+		}
+	}
+	if err := checkHostOrder(settings.HostOrder); err != nil {
+		problem("host_order", "%v", err)
+	}
+	if settings.Port < 0 || settings.Port > 65535 {
+		problem("port", "invalid port %d", settings.Port)
+	}
+	if usesTLS {
+		problems = append(problems, checkTLSSettings(settings.TLS, jsonPath(path, "tls"))...)
+	}
+
+	// Exchange and publishing
+	if settings.Exchange.Name == "" {
+		problem("exchange.name", "missing")
+	}
+	if settings.Exchange.Type == "" {
+		problem("exchange.type", "missing")
+	} else if !exchangeTypes[settings.Exchange.Type] && !strings.HasPrefix(settings.Exchange.Type, "x-") {
+		problem("exchange.type", "invalid exchange type %q, use direct, fanout, topic, headers or a plugin x- type",
+			settings.Exchange.Type)
+	}
+	if _, err := parseRoutingKey(settings.Publish.Key, settings.Publish.KeyFallback); err != nil {
+		problem("publish.key", "%v", err)
+	}
+	if settings.Publish.MaxRetries != nil && *settings.Publish.MaxRetries < 0 {
+		problem("publish.max_retries", "must not be negative")
+	}
+
+	// Buffering and batching
+	if err := checkDropPolicy(settings.Buffer.DropPolicy); err != nil {
+		problem("buffer.drop_policy", "%v", err)
+	}
+	if err := checkBatchFormat(settings.Batch.Format); err != nil {
+		problem("batch.format", "%v", err)
+	}
+	if err := checkCompression(settings.Batch.Compression); err != nil {
+		problem("batch.compression", "%v", err)
+	}
+
+	for i, queue := range settings.Queues {
+		queuePath := "queues[" + strconv.Itoa(i) + "]"
+		if queue.Name == "" {
+			problem(queuePath+".name", "missing")
+		}
+		if err := checkOverflow(queue.Overflow); err != nil {
+			problem(queuePath+".overflow", "%v", err)
+		}
+	}
+
+	return problems
+}
+
+// checkTLSSettings returns the problems of the TLS settings at a JSON path,
+// including the files that cannot be read.
+func checkTLSSettings(settings RabbitMQTLSSettings, path string) []configProblem {
+	var problems []configProblem
+	problem := func(key, format string, a ...interface{}) {
+		problems = append(problems, configProblem{jsonPath(path, key), fmt.Sprintf(format, a...)})
+	}
+
+	if settings.CACertFile != "" {
+		if ca, err := ioutil.ReadFile(settings.CACertFile); err != nil {
+			problem("ca_cert_file", "%v", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			problem("ca_cert_file", "no PEM certificates found in %s", settings.CACertFile)
+		}
+	}
+
+	switch {
+	case settings.CertFile == "" && settings.KeyFile != "":
+		problem("cert_file", "missing, needed with key_file")
+	case settings.CertFile != "" && settings.KeyFile == "":
+		problem("key_file", "missing, needed with cert_file")
+	case settings.CertFile != "":
+		if _, err := ioutil.ReadFile(settings.CertFile); err != nil {
+			problem("cert_file", "%v", err)
+		} else if _, err := ioutil.ReadFile(settings.KeyFile); err != nil {
+			problem("key_file", "%v", err)
+		} else if _, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile); err != nil {
+			problem("cert_file", "%v", err)
+		}
+	}
+
+	if _, err := tlsVersion(settings.MinVersion); err != nil {
+		problem("min_version", "%v", err)
+	}
+	for i, name := range settings.CipherSuites {
+		if _, err := tlsCipherSuite(name); err != nil {
+			problem("cipher_suites["+strconv.Itoa(i)+"]", "%v", err)
+		}
+	}
+	for i, pin := range settings.PinnedSPKISHA256 {
+		if _, err := parsePin(pin); err != nil {
+			problem("pinned_spki_sha256["+strconv.Itoa(i)+"]", "%v", err)
+		}
+	}
+
+	return problems
+}
+
+// sinkStatuses tells which sinks records would be sent to with the
+// settings.
+func sinkStatuses(settings *Settings) []sinkStatus {
+	rabbitMQ := sinkStatus{Name: "rabbitmq", Enabled: rabbitMQEnabled(settings.RabbitMQ)}
+	if rabbitMQ.Enabled {
+		rabbitMQ.Reason = fmt.Sprintf("exchange %s (%s)", settings.RabbitMQ.Exchange.Name, settings.RabbitMQ.Exchange.Type)
+	} else if rabbitMQConfigured(settings.RabbitMQ) {
+		rabbitMQ.Reason = "incomplete settings"
+	} else {
+		rabbitMQ.Reason = "no settings"
+	}
+
+	stdout := sinkStatus{Name: "stdout", Enabled: !rabbitMQ.Enabled}
+	if rabbitMQ.Enabled {
+		stdout.Reason = "records are sent to RabbitMQ"
+	} else {
+		stdout.Reason = "records are printed as JSON"
+	}
+
+	return []sinkStatus{stdout, rabbitMQ}
+}
+
+// validateConfig implements the validate-config command, printing the
+// problems of a configuration file and the sinks it enables. The exit
+// status is 1 if there are problems.
+func validateConfig(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to configuration file in JSON format")
+	flags.Parse(args)
+
+	path := *configPath
+	if path == "" && flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "Failed to validate configuration: -config is required")
+		return exitFailure
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read configuration:", err)
+		return exitFailure
+	}
+	settings, problems, err := validateSettings(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to validate configuration:", err)
+		return exitFailure
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	for _, sink := range sinkStatuses(settings) {
+		state := "disabled"
+		if sink.Enabled {
+			state = "enabled"
+		}
+		fmt.Printf("Sink %s: %s, %s\n", sink.Name, state, sink.Reason)
+	}
+
+	switch len(problems) {
+	case 0:
+	case 1:
+		fmt.Printf("%s: 1 problem\n", path)
+		return exitFailure
+	default:
+		fmt.Printf("%s: %d problems\n", path, len(problems))
+		return exitFailure
+	}
+	fmt.Printf("%s: valid\n", path)
+	return exitSuccess
+}